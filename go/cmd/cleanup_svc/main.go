@@ -2,12 +2,20 @@ package main
 
 import (
 	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"os"
+	"strings"
 	"sync"
-	"time"
 )
 
 func main() {
@@ -24,7 +32,7 @@ func main() {
 }
 
 func performCleanupTask(wsServer string) {
-	conn, err := net.Dial("tcp", wsServer)
+	conn, err := dialWsServer(wsServer)
 	if err != nil {
 		panic(err)
 	}
@@ -33,19 +41,120 @@ func performCleanupTask(wsServer string) {
 	slog.Info("Connected to WS Server at ", "addr", conn.RemoteAddr().String())
 
 	scanner := bufio.NewScanner(conn)
-	for range 10 {
-		n, err := fmt.Fprintln(conn, "10")
-		if err != nil || n == 0 {
-			slog.Error("Failed to write to service", "error", err)
+
+	if secret := os.Getenv("CONTROL_ADMIN_SECRET"); secret != "" {
+		if err := authenticate(conn, scanner, secret); err != nil {
+			slog.Error("Failed to authenticate with WS Server", "error", err)
+			return
+		}
+	}
+
+	// The WS server paces the drain itself, we trigger it once and watch
+	// every close until it finishes
+	n, err := fmt.Fprintln(conn, "watch drain rate=10 interval=10s")
+	if err != nil || n == 0 {
+		slog.Error("Failed to write to service", "error", err)
+		return
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Error: ") {
+			slog.Error("Drain rejected", "error", strings.TrimPrefix(line, "Error: "))
+			return
+		}
+
+		var event struct {
+			Type         string `json:"type"`
+			ConnectionID string `json:"connection_id"`
+			Outcome      string `json:"outcome"`
+			State        string `json:"state"`
+			Clean        int    `json:"clean"`
+			Failed       int    `json:"failed"`
+			Gone         int    `json:"gone"`
+			Elapsed      string `json:"elapsed"`
+		}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			slog.Error("Failed to decode drain event", "line", line, "error", err)
+			continue
+		}
+
+		switch event.Type {
+		case "close_result":
+			slog.Info("Connection closed", "id", event.ConnectionID, "outcome", event.Outcome)
+		case "summary":
+			slog.Info(
+				"Drain finished",
+				"clean", event.Clean,
+				"failed", event.Failed,
+				"gone", event.Gone,
+				"elapsed", event.Elapsed,
+			)
+			if event.Failed > 0 {
+				slog.Warn("Some clients did not receive a close frame", "failed", event.Failed)
+			}
 			return
+		default:
+			slog.Info("Drain event", "type", event.Type, "state", event.State)
 		}
+	}
+	slog.Error("Service closed the connection", "error", scanner.Err())
+}
+
+// dialWsServer connects to the service communication port, over mutual TLS
+// when CONTROL_TLS_CERT and CONTROL_TLS_KEY are set
+func dialWsServer(addr string) (net.Conn, error) {
+	certFile, keyFile := os.Getenv("CONTROL_TLS_CERT"), os.Getenv("CONTROL_TLS_KEY")
+	if certFile == "" || keyFile == "" {
+		return net.Dial("tcp", addr)
+	}
 
-		if scanner.Scan() {
-			slog.Info("Received from service", "message", scanner.Text())
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile := os.Getenv("CONTROL_TLS_CA"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("CA file contains no certificates")
 		}
+	}
+	return tls.Dial("tcp", addr, tlsCfg)
+}
+
+// authenticate answers the server's "AUTH <challenge>" line with the
+// HMAC-SHA256 of the challenge keyed by secret
+func authenticate(conn net.Conn, scanner *bufio.Scanner, secret string) error {
+	if !scanner.Scan() {
+		return errors.New("connection closed before authentication challenge")
+	}
+	challenge, ok := strings.CutPrefix(scanner.Text(), "AUTH ")
+	if !ok {
+		return fmt.Errorf("unexpected authentication challenge %q", scanner.Text())
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(challenge))
+	if _, err := fmt.Fprintln(conn, "AUTH "+hex.EncodeToString(mac.Sum(nil))); err != nil {
+		return err
+	}
 
-		time.Sleep(10 * time.Second)
+	if !scanner.Scan() {
+		return errors.New("connection closed during authentication")
+	}
+	if !strings.HasPrefix(scanner.Text(), "OK ") {
+		return fmt.Errorf("authentication rejected: %s", scanner.Text())
 	}
+	slog.Info("Authenticated with WS Server", "role", strings.TrimPrefix(scanner.Text(), "OK "))
+	return nil
 }
 
 func listenForPreStop(continueCh chan<- struct{}, closeOnce *sync.Once) {
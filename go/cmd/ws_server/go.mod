@@ -4,3 +4,5 @@ module github.com/ArditZubaku/go-node-ws
 go 1.24.3
 
 require github.com/gorilla/websocket v1.5.3
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,198 @@
+// Package admin serves the HTTP admin API. It runs on its own listener,
+// away from the public WebSocket port, and executes every request through
+// the control package like the TCP service port does.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/control"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+	"github.com/ArditZubaku/go-node-ws/internal/shutdown"
+)
+
+// maxBodySize bounds the size of a request body
+const maxBodySize = 1 << 20
+
+// Config controls the admin listener. The API is disabled unless at least
+// one token is set.
+type Config struct {
+	// Token grants the admin role, ReadOnlyToken the read role
+	Token         string
+	ReadOnlyToken string
+	// Settings is the redacted server configuration served at /admin/config
+	Settings any
+}
+
+// Enabled reports whether the API should be served
+func (c Config) Enabled() bool {
+	return c.Token != "" || c.ReadOnlyToken != ""
+}
+
+type Server struct {
+	cfg    Config
+	cm     *connmanager.ConnectionManager
+	engine *drain.Engine
+	orch   *shutdown.Orchestrator
+	http   *http.Server
+}
+
+func NewServer(cfg Config, cm *connmanager.ConnectionManager, engine *drain.Engine, orch *shutdown.Orchestrator) *Server {
+	mux := http.NewServeMux()
+	s := &Server{
+		cfg:    cfg,
+		cm:     cm,
+		engine: engine,
+		orch:   orch,
+		http: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       60 * time.Second,
+		},
+	}
+
+	mux.HandleFunc("GET /admin/status", s.command("status", noArgs))
+	mux.HandleFunc("GET /admin/shutdown", s.command("phase", noArgs))
+	mux.HandleFunc("GET /admin/config", s.settings)
+	mux.HandleFunc("GET /admin/connections", s.command("list", listArgs))
+	mux.HandleFunc("GET /admin/connections/{id}", s.command("get", bodyWithID))
+	mux.HandleFunc("DELETE /admin/connections/{id}", s.command("kick", bodyWithID))
+	mux.HandleFunc("POST /admin/connections/{id}/messages", s.command("send", bodyWithID))
+	mux.HandleFunc("POST /admin/broadcast", s.command("broadcast", body))
+	mux.HandleFunc("POST /admin/close", s.command("close", body))
+	mux.HandleFunc("POST /admin/drain", s.command("drain", body))
+	mux.HandleFunc("PATCH /admin/drain", s.command("retune", body))
+	mux.HandleFunc("POST /admin/drain/pause", s.command("pause", noArgs))
+	mux.HandleFunc("POST /admin/drain/resume", s.command("resume", noArgs))
+	mux.HandleFunc("POST /admin/drain/cancel", s.command("cancel", noArgs))
+	mux.HandleFunc("POST /admin/upgrade", s.command("upgrade", noArgs))
+
+	return s
+}
+
+// Serve serves the admin API on ln until the process exits or ln is handed
+// over by an upgrade. It stays up during shutdown so the phases can be
+// followed.
+func (s *Server) Serve(ln net.Listener) {
+	slog.Info("Admin API listening on", "addr", ln.Addr().String(), "read_only_token", s.cfg.ReadOnlyToken != "")
+	if err := s.http.Serve(ln); err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+		slog.Error("Admin API error", "error", err)
+	}
+}
+
+// argsFunc builds the control request arguments from an HTTP request
+type argsFunc func(r *http.Request) (json.RawMessage, error)
+
+// command serves one control command. The response is the control protocol
+// response, with the HTTP status derived from its error code.
+func (s *Server) command(name string, args argsFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := control.Request{
+			Version: control.ProtocolVersion,
+			ID:      r.Header.Get("X-Request-ID"),
+			Command: name,
+		}
+
+		role, ok := s.authenticate(r)
+		if !ok {
+			unauthorized(w, r)
+			return
+		}
+
+		var resp control.Response
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		raw, err := args(r)
+		if err != nil {
+			resp = control.Response{
+				Version: control.ProtocolVersion,
+				ID:      req.ID,
+				Error:   control.NewError(control.CodeBadRequest, "%s", err),
+			}
+		} else {
+			req.Args = raw
+			resp = control.Run(req, io.Discard, role, s.cm, s.engine, s.orch)
+		}
+		writeResponse(w, statusCode(resp.Error), resp)
+	}
+}
+
+// settings serves the configuration to any authenticated client. It is not
+// a control command since the service port has no use for it.
+func (s *Server) settings(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(r); !ok {
+		unauthorized(w, r)
+		return
+	}
+	writeResponse(w, http.StatusOK, control.Response{
+		Version: control.ProtocolVersion,
+		ID:      r.Header.Get("X-Request-ID"),
+		OK:      true,
+		Result:  s.cfg.Settings,
+	})
+}
+
+// authenticate maps the bearer token of r to the role it grants
+func (s *Server) authenticate(r *http.Request) (control.Role, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	if tokenEqual(token, s.cfg.Token) {
+		return control.RoleAdmin, true
+	}
+	if tokenEqual(token, s.cfg.ReadOnlyToken) {
+		return control.RoleReadOnly, true
+	}
+	return "", false
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	slog.Warn("Admin API authentication failed", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeResponse(w, http.StatusUnauthorized, control.Response{
+		Version: control.ProtocolVersion,
+		ID:      r.Header.Get("X-Request-ID"),
+		Error:   control.NewError(control.CodeUnauthorized, "missing or invalid bearer token"),
+	})
+}
+
+func tokenEqual(got, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func statusCode(err *control.Error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	switch err.Code {
+	case control.CodeBadRequest, control.CodeInvalidArgument, control.CodeUnsupportedVersion:
+		return http.StatusBadRequest
+	case control.CodeForbidden:
+		return http.StatusForbidden
+	case control.CodeNotFound, control.CodeUnknownCommand:
+		return http.StatusNotFound
+	case control.CodeConflict:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeResponse(w http.ResponseWriter, code int, resp control.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(resp); err != nil {
+		slog.Error("Failed to encode admin response", "error", err)
+	}
+}
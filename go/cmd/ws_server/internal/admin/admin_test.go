@@ -0,0 +1,162 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/control"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+	"github.com/ArditZubaku/go-node-ws/internal/shutdown"
+)
+
+func newServer() *Server {
+	cm := connmanager.NewConnectionManager()
+	engine := drain.NewEngine(cm)
+	orch := shutdown.NewOrchestrator(cm, engine, shutdown.Config{})
+	cfg := Config{Token: "admin-token", ReadOnlyToken: "read-token", Settings: map[string]string{"addr": ":8080"}}
+	return NewServer(cfg, cm, engine, orch)
+}
+
+// do sends a request to s and decodes the control response
+func do(t *testing.T, s *Server, method, path, token, body string) (*httptest.ResponseRecorder, control.Response) {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	r.Header.Set("X-Request-ID", "req-1")
+	rec := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rec, r)
+
+	var resp control.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s %s: response %q", method, path, rec.Body)
+	}
+	if resp.ID != "req-1" {
+		t.Errorf("%s %s: response ID %q", method, path, resp.ID)
+	}
+	return rec, resp
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newServer()
+	for _, token := range []string{"", "wrong-token"} {
+		rec, resp := do(t, s, "GET", "/admin/status", token, "")
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("token %q: status %d, WWW-Authenticate %q", token, rec.Code, rec.Header().Get("WWW-Authenticate"))
+		}
+		if resp.Error == nil || resp.Error.Code != control.CodeUnauthorized {
+			t.Errorf("token %q: error %+v", token, resp.Error)
+		}
+	}
+
+	for _, token := range []string{"admin-token", "read-token"} {
+		for _, path := range []string{"/admin/status", "/admin/shutdown", "/admin/config", "/admin/connections"} {
+			if rec, _ := do(t, s, "GET", path, token, ""); rec.Code != http.StatusOK {
+				t.Errorf("%s with %s: status %d", path, token, rec.Code)
+			}
+		}
+	}
+}
+
+func TestReadOnlyToken(t *testing.T) {
+	s := newServer()
+	requests := []struct{ method, path string }{
+		{"POST", "/admin/close"},
+		{"POST", "/admin/drain"},
+		{"PATCH", "/admin/drain"},
+		{"POST", "/admin/drain/pause"},
+		{"POST", "/admin/drain/cancel"},
+		{"POST", "/admin/broadcast"},
+		{"DELETE", "/admin/connections/abc"},
+		{"POST", "/admin/connections/abc/messages"},
+		{"POST", "/admin/upgrade"},
+	}
+	for _, req := range requests {
+		rec, resp := do(t, s, req.method, req.path, "read-token", "")
+		if rec.Code != http.StatusForbidden || resp.Error == nil || resp.Error.Code != control.CodeForbidden {
+			t.Errorf("%s %s: status %d, error %+v", req.method, req.path, rec.Code, resp.Error)
+		}
+	}
+}
+
+func TestStatusCodes(t *testing.T) {
+	s := newServer()
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"GET", "/admin/status", "", http.StatusOK},
+		{"POST", "/admin/close", "not json", http.StatusBadRequest},
+		{"POST", "/admin/close", `{"count":0}`, http.StatusBadRequest},
+		{"GET", "/admin/connections?limit=ten", "", http.StatusBadRequest},
+		{"GET", "/admin/connections/unknown", "", http.StatusNotFound},
+		{"POST", "/admin/drain/pause", "", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if rec, _ := do(t, s, tt.method, tt.path, "admin-token", tt.body); rec.Code != tt.want {
+			t.Errorf("%s %s %s: status %d, want %d", tt.method, tt.path, tt.body, rec.Code, tt.want)
+		}
+	}
+
+	codes := map[control.ErrorCode]int{
+		control.CodeBadRequest:         http.StatusBadRequest,
+		control.CodeInvalidArgument:    http.StatusBadRequest,
+		control.CodeUnsupportedVersion: http.StatusBadRequest,
+		control.CodeForbidden:          http.StatusForbidden,
+		control.CodeNotFound:           http.StatusNotFound,
+		control.CodeUnknownCommand:     http.StatusNotFound,
+		control.CodeConflict:           http.StatusConflict,
+		control.CodeInternal:           http.StatusInternalServerError,
+	}
+	for code, want := range codes {
+		if got := statusCode(control.NewError(code, "")); got != want {
+			t.Errorf("statusCode(%s) = %d, want %d", code, got, want)
+		}
+	}
+	if got := statusCode(nil); got != http.StatusOK {
+		t.Errorf("statusCode(nil) = %d", got)
+	}
+}
+
+func TestBodyWithID(t *testing.T) {
+	tests := map[string]string{
+		"":                           `{"id":"abc"}`,
+		`{"data":"hi"}`:              `{"data":"hi","id":"abc"}`,
+		`{"id":"other","code":1000}`: `{"code":1000,"id":"abc"}`,
+	}
+	for body, want := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.SetPathValue("id", "abc")
+		got, err := bodyWithID(r)
+		if err != nil || string(got) != want {
+			t.Errorf("body %q: %s, %v, want %s", body, got, err, want)
+		}
+	}
+
+	for _, body := range []string{"[1]", `"abc"`, "{"} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.SetPathValue("id", "abc")
+		if _, err := bodyWithID(r); err == nil {
+			t.Errorf("body %q: no error", body)
+		}
+	}
+}
+
+func TestListArgs(t *testing.T) {
+	r := httptest.NewRequest("GET", "/admin/connections?offset=2&limit=5&client_ip=10.0.0.1&tag=beta&other=x", nil)
+	got, err := listArgs(r)
+	if want := `{"client_ip":"10.0.0.1","limit":5,"offset":2,"tag":"beta"}`; err != nil || string(got) != want {
+		t.Errorf("listArgs = %s, %v, want %s", got, err, want)
+	}
+
+	for _, query := range []string{"offset=abc", "limit=1.5"} {
+		if _, err := listArgs(httptest.NewRequest("GET", "/admin/connections?"+query, nil)); err == nil {
+			t.Errorf("%s: no error", query)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+func noArgs(*http.Request) (json.RawMessage, error) {
+	return nil, nil
+}
+
+// body passes the JSON request body on as the command arguments
+func body(r *http.Request) (json.RawMessage, error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 0 && !json.Valid(b) {
+		return nil, errors.New("request body is not valid JSON")
+	}
+	return b, nil
+}
+
+// bodyWithID is body with the connection ID from the path added
+func bodyWithID(r *http.Request) (json.RawMessage, error) {
+	raw, err := body(r)
+	if err != nil {
+		return nil, err
+	}
+	args := map[string]json.RawMessage{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return nil, errors.New("request body must be a JSON object")
+		}
+	}
+	id, err := json.Marshal(r.PathValue("id"))
+	if err != nil {
+		return nil, err
+	}
+	args["id"] = id
+	return json.Marshal(args)
+}
+
+// listArgs reads the list pagination and filters from the query string
+func listArgs(r *http.Request) (json.RawMessage, error) {
+	query := r.URL.Query()
+	args := map[string]any{}
+	for _, key := range []string{"offset", "limit"} {
+		if v := query.Get(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", key, v)
+			}
+			args[key] = n
+		}
+	}
+	for _, key := range []string{"client_ip", "path", "tag"} {
+		if v := query.Get(key); v != "" {
+			args[key] = v
+		}
+	}
+	return json.Marshal(args)
+}
@@ -0,0 +1,68 @@
+// Package agentcheck serves the HAProxy agent-check protocol, letting HAProxy
+// learn from the ws_server itself when to stop sending it new connections.
+package agentcheck
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+)
+
+const writeTimeout = 2 * time.Second
+
+// Report builds the agent-check reply for the current server state.
+// A draining server answers "drain", otherwise the weight shrinks linearly
+// as the connection count approaches capacity. A capacity of 0 disables
+// weighting.
+func Report(cm *connmanager.ConnectionManager, capacity int) string {
+	if cm.Draining() {
+		return "drain"
+	}
+
+	weight := 100
+	if capacity > 0 {
+		used := cm.GetConnectionsCount() * 100 / capacity
+		// Keep at least 1% so HAProxy does not treat a full server as drained
+		weight = max(1, 100-used)
+	}
+	return fmt.Sprintf("up ready %d%%", weight)
+}
+
+// HandleAgentChecks answers every connection on ln with a single Report
+// line and then closes it, as HAProxy's agent-check expects
+func HandleAgentChecks(cm *connmanager.ConnectionManager, ln net.Listener, capacity int) {
+	defer ln.Close()
+
+	slog.Info("Agent check server listening on", "addr", ln.Addr().String(), "capacity", capacity)
+
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to accept agent check connection", "error", err)
+			continue
+		}
+		go handleAgentCheck(conn, cm, capacity)
+	}
+}
+
+func handleAgentCheck(conn net.Conn, cm *connmanager.ConnectionManager, capacity int) {
+	defer conn.Close()
+
+	report := Report(cm, capacity)
+	slog.Debug("Answering agent check", "remote_addr", conn.RemoteAddr(), "report", report)
+
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		slog.Error("Failed to set agent check deadline", "error", err)
+		return
+	}
+	if _, err := fmt.Fprintln(conn, report); err != nil {
+		slog.Error("Failed to write agent check report", "error", err)
+	}
+}
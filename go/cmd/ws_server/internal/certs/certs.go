@@ -0,0 +1,218 @@
+// Package certs terminates TLS for the WebSocket listener. The certificate,
+// key and client CA are read from files and reloaded when they change on
+// disk; a reload only affects new handshakes, established connections keep
+// the certificate they were opened with.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+)
+
+// ClientAuth decides whether clients must present a certificate signed by
+// the client CA
+type ClientAuth string
+
+const (
+	// ClientAuthOptional verifies a certificate when the client sends one
+	ClientAuthOptional ClientAuth = "optional"
+	// ClientAuthRequire rejects clients without a valid certificate
+	ClientAuthRequire ClientAuth = "require"
+)
+
+// ParseClientAuth parses a ClientAuth name, empty meaning require
+func ParseClientAuth(s string) (ClientAuth, error) {
+	switch a := ClientAuth(s); a {
+	case "":
+		return ClientAuthRequire, nil
+	case ClientAuthOptional, ClientAuthRequire:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown client auth %q (optional, require)", s)
+	}
+}
+
+// ParseVersion parses a minimum TLS version, "1.2" or "1.3"
+func ParseVersion(s string) (uint16, error) {
+	switch s {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q (1.2, 1.3)", s)
+	}
+}
+
+// Config names the files TLS is served from
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables client certificate verification
+	ClientCAFile string
+	ClientAuth   ClientAuth
+	MinVersion   uint16
+	// ReloadInterval is how often the files are checked for changes, 0
+	// disables reloading
+	ReloadInterval time.Duration
+}
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Reloader holds the current certificate and client CA
+type Reloader struct {
+	cfg Config
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	stamps    map[string]fileStamp
+}
+
+// NewReloader loads the files named by cfg
+func NewReloader(cfg Config) (*Reloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("TLS requires a certificate and a key")
+	}
+	r := &Reloader{cfg: cfg}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+// load reads the files. Nothing changes when one of them is invalid.
+func (r *Reloader) load() error {
+	stamps := make(map[string]fileStamp)
+	for _, name := range r.files() {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		stamps[name] = fileStamp{fi.ModTime(), fi.Size()}
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("read client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("client CA file contains no certificates")
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.clientCAs, r.stamps = &cert, pool, stamps
+	if cert.Leaf != nil {
+		slog.Info("Loaded TLS certificate", "subject", cert.Leaf.Subject.String(), "not_after", cert.Leaf.NotAfter)
+	}
+	return nil
+}
+
+// changed reports whether a file differs from the loaded version
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, name := range r.files() {
+		fi, err := os.Stat(name)
+		if err != nil {
+			// Possibly mid-update, check again next time
+			continue
+		}
+		if r.stamps[name] != (fileStamp{fi.ModTime(), fi.Size()}) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the files whenever they change until stop is closed. An
+// invalid update is logged and the previous certificate kept.
+func (r *Reloader) Watch(stop <-chan struct{}) {
+	if r.cfg.ReloadInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.cfg.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.load(); err != nil {
+				slog.Error("Failed to reload TLS certificate, keeping the previous one", "error", err)
+				metrics.CertificateReloads.Inc("failed")
+				continue
+			}
+			metrics.CertificateReloads.Inc("reloaded")
+		case <-stop:
+			return
+		}
+	}
+}
+
+// TLSConfig returns a server configuration that uses the current
+// certificate and client CA for every handshake
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.cfg.MinVersion,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			cert, pool := r.cert, r.clientCAs
+			r.mu.RUnlock()
+
+			cfg := &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				MinVersion:   r.cfg.MinVersion,
+				// WebSockets need HTTP/1.1
+				NextProtos: []string{"http/1.1"},
+			}
+			if pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				if r.cfg.ClientAuth == ClientAuthOptional {
+					cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				}
+			}
+			if hc, ok := hello.Conn.(*handshakeConn); ok {
+				hc.start(cfg)
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// NewListener serves TLS on ln with the reloaded certificates
+func (r *Reloader) NewListener(ln net.Listener) net.Listener {
+	return tls.NewListener(handshakeListener{ln}, r.TLSConfig())
+}
@@ -0,0 +1,157 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for commonName and its key
+func writeCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dial completes a handshake and returns the connection with the common
+// name of the server certificate
+func dial(t *testing.T, addr string) (*tls.Conn, string) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloadKeepsConnections(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "first")
+
+	r, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile, MinVersion: tls.VersionTLS12, ReloadInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Watch(stop)
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := r.NewListener(raw)
+	defer ln.Close()
+	infos := make(chan *Info, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// Echo bytes, the first read completes the handshake
+				b := make([]byte, 1)
+				for {
+					if _, err := conn.Read(b); err != nil {
+						return
+					}
+					infos <- InfoOf(conn)
+					conn.Write(b)
+				}
+			}()
+		}
+	}()
+
+	first, name := dial(t, ln.Addr().String())
+	defer first.Close()
+	if name != "first" {
+		t.Fatalf("served %q, want first", name)
+	}
+	first.Write([]byte{1})
+	first.Read(make([]byte, 1))
+	info := <-infos
+	if info == nil || info.Version == "" || info.Handshake == "" {
+		t.Errorf("info = %+v, want the version and handshake time", info)
+	}
+
+	// Different size, so the change is seen even within the mtime resolution
+	writeCert(t, certFile, keyFile, "second-certificate")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, name := dial(t, ln.Addr().String())
+		conn.Close()
+		if name == "second-certificate" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The connection opened before the reload still works
+	first.Write([]byte{2})
+	<-infos
+	b := make([]byte, 1)
+	first.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := first.Read(b); err != nil || b[0] != 2 {
+		t.Errorf("connection opened before the reload: read %v, %v", b, err)
+	}
+}
+
+func TestInvalidReloadKeepsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "first")
+	r, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !r.changed() {
+		t.Fatal("change not detected")
+	}
+	if err := r.load(); err == nil {
+		t.Fatal("loaded an invalid key")
+	}
+	if r.cert.Leaf.Subject.CommonName != "first" {
+		t.Errorf("certificate replaced by an invalid update")
+	}
+}
@@ -0,0 +1,109 @@
+package certs
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+)
+
+// Info describes the TLS session of a connection
+type Info struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+	ALPN        string `json:"alpn,omitempty"`
+	Resumed     bool   `json:"resumed"`
+	// Handshake is the time from the ClientHello until the handshake was
+	// verified
+	Handshake string `json:"handshake,omitempty"`
+	// ClientCert is the subject of the verified client certificate
+	ClientCert string `json:"client_cert,omitempty"`
+}
+
+// InfoOf returns the TLS session of c, or of the TLS connection it wraps.
+// It is nil for plaintext connections.
+func InfoOf(c net.Conn) *Info {
+	for {
+		if tc, ok := c.(*tls.Conn); ok {
+			return infoOf(tc)
+		}
+		wrapper, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		c = wrapper.NetConn()
+	}
+}
+
+func infoOf(tc *tls.Conn) *Info {
+	state := tc.ConnectionState()
+	info := &Info{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+		ALPN:        state.NegotiatedProtocol,
+		Resumed:     state.DidResume,
+	}
+	if len(state.VerifiedChains) > 0 {
+		info.ClientCert = state.PeerCertificates[0].Subject.String()
+	}
+	if hc, ok := tc.NetConn().(*handshakeConn); ok {
+		if d := hc.duration(); d > 0 {
+			info.Handshake = d.String()
+		}
+	}
+	return info
+}
+
+// handshakeListener times the TLS handshake of the connections it accepts
+type handshakeListener struct {
+	net.Listener
+}
+
+func (l handshakeListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &handshakeConn{Conn: conn}, nil
+}
+
+// handshakeConn is the connection beneath a TLS server connection
+type handshakeConn struct {
+	net.Conn
+	started  time.Time
+	finished atomic.Int64 // Unix nanoseconds
+}
+
+// NetConn returns the accepted connection
+func (c *handshakeConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// start marks the ClientHello and has cfg record the end of the handshake
+func (c *handshakeConn) start(cfg *tls.Config) {
+	c.started = time.Now()
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		c.finished.Store(time.Now().UnixNano())
+		metrics.TLSHandshakes.Inc(tls.VersionName(state.Version), boolLabel(state.DidResume))
+		return nil
+	}
+}
+
+func (c *handshakeConn) duration() time.Duration {
+	finished := c.finished.Load()
+	if finished == 0 || c.started.IsZero() {
+		return 0
+	}
+	return time.Unix(0, finished).Sub(c.started).Round(time.Microsecond)
+}
+
+func boolLabel(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
@@ -0,0 +1,273 @@
+// Package config holds the ws_server settings. They are read from an
+// optional YAML or JSON file, environment variables and command-line flags,
+// each overriding the one before.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/certs"
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/proxyproto"
+	"github.com/ArditZubaku/go-node-ws/internal/shutdown"
+)
+
+// Config is the complete server configuration. Every setting has a yaml key,
+// which also names its flag, and most an environment variable.
+type Config struct {
+	HTTP        HTTP        `yaml:"http"`
+	Control     Control     `yaml:"control"`
+	Admin       Admin       `yaml:"admin"`
+	AgentCheck  AgentCheck  `yaml:"agent_check"`
+	ProxyProto  ProxyProto  `yaml:"proxy_protocol"`
+	Connections Connections `yaml:"connections"`
+	Send        Send        `yaml:"send"`
+	Keepalive   Keepalive   `yaml:"keepalive"`
+	Reconnect   Reconnect   `yaml:"reconnect"`
+	Shutdown    Shutdown    `yaml:"shutdown"`
+	Upgrade     Upgrade     `yaml:"upgrade"`
+	Session     Session     `yaml:"session"`
+}
+
+// HTTP configures the public WebSocket and probe listener
+type HTTP struct {
+	Addr         string        `yaml:"addr" env:"HTTP_ADDR" help:"WebSocket and probe listen address"`
+	ReadTimeout  time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT" help:"time to read a request, 0 disables"`
+	WriteTimeout time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT" help:"time to write a response, 0 disables"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT" help:"keep-alive idle time, 0 disables"`
+
+	TLSCert           string        `yaml:"tls_cert" env:"HTTP_TLS_CERT" help:"server certificate, enables wss://"`
+	TLSKey            string        `yaml:"tls_key" env:"HTTP_TLS_KEY" help:"server private key"`
+	TLSClientCA       string        `yaml:"tls_client_ca" env:"HTTP_TLS_CLIENT_CA" help:"CA bundle client certificates are verified against"`
+	TLSClientAuth     string        `yaml:"tls_client_auth" env:"HTTP_TLS_CLIENT_AUTH" help:"optional or require a client certificate, with tls_client_ca"`
+	TLSMinVersion     string        `yaml:"tls_min_version" env:"HTTP_TLS_MIN_VERSION" help:"1.2 or 1.3"`
+	TLSReloadInterval time.Duration `yaml:"tls_reload_interval" env:"HTTP_TLS_RELOAD_INTERVAL" help:"how often the TLS files are checked for changes, 0 disables"`
+}
+
+// Control configures the TCP service port
+type Control struct {
+	Addr           string   `yaml:"addr" env:"CONTROL_ADDR" help:"service port listen address"`
+	TLSCert        string   `yaml:"tls_cert" env:"CONTROL_TLS_CERT" help:"server certificate, enables TLS"`
+	TLSKey         string   `yaml:"tls_key" env:"CONTROL_TLS_KEY" help:"server private key"`
+	TLSClientCA    string   `yaml:"tls_client_ca" env:"CONTROL_TLS_CLIENT_CA" help:"CA bundle client certificates must be signed by"`
+	AdminCNs       []string `yaml:"admin_cns" env:"CONTROL_ADMIN_CNS" help:"client certificate CNs granted admin, comma-separated"`
+	AdminSecret    string   `yaml:"admin_secret" env:"CONTROL_ADMIN_SECRET" secret:"true" help:"shared secret granting admin"`
+	ReadOnlySecret string   `yaml:"readonly_secret" env:"CONTROL_READONLY_SECRET" secret:"true" help:"shared secret granting read"`
+}
+
+// Admin configures the HTTP admin API
+type Admin struct {
+	Addr          string `yaml:"addr" env:"ADMIN_ADDR" help:"admin API listen address"`
+	Token         string `yaml:"token" env:"ADMIN_TOKEN" secret:"true" help:"bearer token granting admin, enables the API"`
+	ReadOnlyToken string `yaml:"readonly_token" env:"ADMIN_READONLY_TOKEN" secret:"true" help:"bearer token granting read"`
+}
+
+// AgentCheck configures the HAProxy agent-check listener
+type AgentCheck struct {
+	Addr     string `yaml:"addr" env:"AGENT_CHECK_ADDR" help:"agent-check listen address"`
+	Capacity int    `yaml:"capacity" env:"AGENT_CHECK_CAPACITY" help:"connections at which the lowest weight is reported, 0 disables weighting"`
+}
+
+// ProxyProto configures PROXY protocol headers on the WebSocket and service
+// port listeners
+type ProxyProto struct {
+	HTTP          string        `yaml:"http" env:"PROXY_PROTOCOL_HTTP" help:"off, optional or strict on the WebSocket listener"`
+	Control       string        `yaml:"control" env:"PROXY_PROTOCOL_CONTROL" help:"off, optional or strict on the service port"`
+	TrustedCIDRs  []string      `yaml:"trusted_cidrs" env:"PROXY_PROTOCOL_TRUSTED_CIDRS" help:"sources allowed to send headers, comma-separated, required unless both modes are off"`
+	HeaderTimeout time.Duration `yaml:"header_timeout" env:"PROXY_PROTOCOL_HEADER_TIMEOUT" help:"time to read a header"`
+}
+
+// Connections configures connection handling and closing
+type Connections struct {
+	DrainStrategy       string        `yaml:"drain_strategy" env:"DRAIN_STRATEGY" help:"default drain strategy"`
+	InFlightPolicy      string        `yaml:"in_flight_policy" env:"INFLIGHT_POLICY" help:"interrupt or wait for running operations on close"`
+	InFlightWaitTimeout time.Duration `yaml:"in_flight_wait_timeout" env:"INFLIGHT_WAIT_TIMEOUT" help:"how long the wait policy waits"`
+	SlowRequestDuration time.Duration `yaml:"slow_request_duration" env:"SLOW_REQUEST_DURATION" help:"duration of a SLOW_REQUEST operation"`
+	LogThreshold        int           `yaml:"log_threshold" env:"CONNECTION_LOG_THRESHOLD" help:"connection count logged when reached, 0 disables"`
+}
+
+// Send configures the per-connection send queue
+type Send struct {
+	QueueSize      int           `yaml:"queue_size" env:"SEND_QUEUE_SIZE" help:"messages queued per connection"`
+	OverflowPolicy string        `yaml:"overflow_policy" env:"SEND_OVERFLOW_POLICY" help:"drop, close or block when the queue is full"`
+	BlockTimeout   time.Duration `yaml:"block_timeout" env:"SEND_BLOCK_TIMEOUT" help:"how long the block policy waits"`
+	WriteTimeout   time.Duration `yaml:"write_timeout" env:"SEND_WRITE_TIMEOUT" help:"time to write a single frame"`
+	CloseTimeout   time.Duration `yaml:"close_timeout" env:"SEND_CLOSE_TIMEOUT" help:"time to queue and write a close frame"`
+}
+
+// Keepalive configures pings and idle reaping
+type Keepalive struct {
+	PingInterval time.Duration `yaml:"ping_interval" env:"PING_INTERVAL" help:"ping interval, 0 disables pings"`
+	PongTimeout  time.Duration `yaml:"pong_timeout" env:"PONG_TIMEOUT" help:"time to answer a ping"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT" help:"close connections idle this long, 0 disables"`
+}
+
+// Reconnect configures the reconnect advisory sent before close frames
+type Reconnect struct {
+	Delay    time.Duration `yaml:"delay" env:"RECONNECT_DELAY" help:"advised reconnect delay"`
+	Jitter   time.Duration `yaml:"jitter" env:"RECONNECT_JITTER" help:"advised random extra delay"`
+	Spread   time.Duration `yaml:"spread" env:"RECONNECT_SPREAD" help:"window delays of connections closed together are staggered over"`
+	Endpoint string        `yaml:"endpoint" env:"RECONNECT_ENDPOINT" help:"advised reconnect URL, empty for the same one"`
+}
+
+// Shutdown configures the shutdown phase timeouts
+type Shutdown struct {
+	ReadinessDelay       time.Duration `yaml:"readiness_delay" env:"SHUTDOWN_READINESS_DELAY" help:"time to report not-ready before closing listeners"`
+	StopAcceptingTimeout time.Duration `yaml:"stop_accepting_timeout" env:"SHUTDOWN_STOP_ACCEPTING_TIMEOUT" help:"time to close the listeners"`
+	DrainDuration        time.Duration `yaml:"drain_duration" env:"SHUTDOWN_DRAIN_DURATION" help:"window the remaining connections are drained over"`
+	InFlightGrace        time.Duration `yaml:"in_flight_grace" env:"SHUTDOWN_INFLIGHT_GRACE" help:"time in-flight operations may keep running"`
+	CloseTimeout         time.Duration `yaml:"close_timeout" env:"SHUTDOWN_CLOSE_TIMEOUT" help:"time clients get to answer close frames"`
+}
+
+// Upgrade configures in-place binary upgrades
+type Upgrade struct {
+	ReadyTimeout  time.Duration `yaml:"ready_timeout" env:"UPGRADE_READY_TIMEOUT" help:"time the new process has to start listening"`
+	DrainDuration time.Duration `yaml:"drain_duration" env:"UPGRADE_DRAIN_DURATION" help:"window the old process drains its connections over"`
+}
+
+// Session configures session resumption
+type Session struct {
+	Store  string        `yaml:"store" env:"SESSION_STORE" help:"memory or file"`
+	Dir    string        `yaml:"dir" env:"SESSION_DIR" help:"directory of the file store"`
+	TTL    time.Duration `yaml:"ttl" env:"SESSION_TTL" help:"how long a suspended session can be resumed"`
+	Buffer int           `yaml:"buffer" env:"SESSION_BUFFER" help:"messages buffered per session for replay"`
+}
+
+// Default returns the settings the server uses when nothing is configured
+func Default() Config {
+	send := connmanager.DefaultSendOptions()
+	keepalive := connmanager.DefaultKeepaliveOptions()
+	stop := shutdown.DefaultConfig()
+	return Config{
+		HTTP: HTTP{
+			Addr:         ":8080",
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  60 * time.Second,
+
+			TLSClientAuth:     string(certs.ClientAuthRequire),
+			TLSMinVersion:     "1.2",
+			TLSReloadInterval: 10 * time.Second,
+		},
+		Control:    Control{Addr: ":9999"},
+		Admin:      Admin{Addr: ":9997"},
+		AgentCheck: AgentCheck{Addr: ":9998", Capacity: 1000},
+		ProxyProto: ProxyProto{
+			HTTP:          string(proxyproto.ModeOff),
+			Control:       string(proxyproto.ModeOff),
+			HeaderTimeout: 5 * time.Second,
+		},
+		Connections: Connections{
+			DrainStrategy:       connmanager.StrategyOldest,
+			InFlightPolicy:      string(connmanager.PolicyInterrupt),
+			InFlightWaitTimeout: 30 * time.Second,
+			SlowRequestDuration: 30 * time.Second,
+			LogThreshold:        100,
+		},
+		Send: Send{
+			QueueSize:      send.QueueSize,
+			OverflowPolicy: string(send.Overflow),
+			BlockTimeout:   send.BlockTimeout,
+			WriteTimeout:   send.WriteTimeout,
+			CloseTimeout:   send.CloseTimeout,
+		},
+		Keepalive: Keepalive{
+			PingInterval: keepalive.PingInterval,
+			PongTimeout:  keepalive.PongTimeout,
+			IdleTimeout:  keepalive.IdleTimeout,
+		},
+		Reconnect: Reconnect{
+			Delay:  time.Second,
+			Jitter: 2 * time.Second,
+		},
+		Shutdown: Shutdown{
+			ReadinessDelay:       stop.DeregisterDelay,
+			StopAcceptingTimeout: stop.StopAcceptingTimeout,
+			DrainDuration:        stop.DrainDuration,
+			InFlightGrace:        stop.InFlightGrace,
+			CloseTimeout:         stop.CloseTimeout,
+		},
+		Upgrade: Upgrade{
+			ReadyTimeout:  10 * time.Second,
+			DrainDuration: stop.UpgradeDrainDuration,
+		},
+		Session: Session{
+			Store:  "memory",
+			TTL:    5 * time.Minute,
+			Buffer: 64,
+		},
+	}
+}
+
+// Validate reports every invalid setting
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	walk(&c, func(l leaf) {
+		if d, ok := l.value.Interface().(time.Duration); ok {
+			check(d >= 0, l.key(), "must not be negative")
+		}
+	})
+
+	check(c.HTTP.Addr != "", "http.addr", "is required")
+	check(c.Control.Addr != "", "control.addr", "is required")
+	check(c.Admin.Addr != "", "admin.addr", "is required")
+	check(c.AgentCheck.Addr != "", "agent_check.addr", "is required")
+	check((c.Control.TLSCert == "") == (c.Control.TLSKey == ""), "control.tls_cert", "and control.tls_key must be set together")
+	check((c.HTTP.TLSCert == "") == (c.HTTP.TLSKey == ""), "http.tls_cert", "and http.tls_key must be set together")
+	check(c.HTTP.TLSClientCA == "" || c.HTTP.TLSCert != "", "http.tls_client_ca", "requires http.tls_cert")
+	if _, err := certs.ParseClientAuth(c.HTTP.TLSClientAuth); err != nil {
+		check(false, "http.tls_client_auth", "%s", err)
+	}
+	if _, err := certs.ParseVersion(c.HTTP.TLSMinVersion); err != nil {
+		check(false, "http.tls_min_version", "%s", err)
+	}
+	check(c.AgentCheck.Capacity >= 0, "agent_check.capacity", "must not be negative")
+
+	httpProxy, err := proxyproto.ParseMode(c.ProxyProto.HTTP)
+	if err != nil {
+		check(false, "proxy_protocol.http", "%s", err)
+	}
+	controlProxy, err := proxyproto.ParseMode(c.ProxyProto.Control)
+	if err != nil {
+		check(false, "proxy_protocol.control", "%s", err)
+	}
+	if _, err := proxyproto.ParsePrefixes(c.ProxyProto.TrustedCIDRs); err != nil {
+		check(false, "proxy_protocol.trusted_cidrs", "%s", err)
+	}
+	// A trusted source can claim any client address, trusting every source
+	// would let clients pick theirs
+	check(len(c.ProxyProto.TrustedCIDRs) > 0 || (httpProxy == proxyproto.ModeOff && controlProxy == proxyproto.ModeOff),
+		"proxy_protocol.trusted_cidrs", "is required unless proxy_protocol.http and proxy_protocol.control are off")
+	check(c.ProxyProto.HeaderTimeout > 0, "proxy_protocol.header_timeout", "must be positive")
+
+	if _, err := connmanager.StrategyByName(c.Connections.DrainStrategy); err != nil {
+		check(false, "connections.drain_strategy", "%s", err)
+	}
+	if _, err := connmanager.ParseInFlightPolicy(c.Connections.InFlightPolicy); err != nil {
+		check(false, "connections.in_flight_policy", "%s", err)
+	}
+	check(c.Connections.SlowRequestDuration > 0, "connections.slow_request_duration", "must be positive")
+	check(c.Connections.LogThreshold >= 0, "connections.log_threshold", "must not be negative")
+
+	check(c.Send.QueueSize >= 1, "send.queue_size", "must be at least 1")
+	if _, err := connmanager.ParseOverflowPolicy(c.Send.OverflowPolicy); err != nil {
+		check(false, "send.overflow_policy", "%s", err)
+	}
+	check(c.Send.WriteTimeout > 0, "send.write_timeout", "must be positive")
+	check(c.Send.CloseTimeout > 0, "send.close_timeout", "must be positive")
+
+	check(c.Upgrade.ReadyTimeout > 0, "upgrade.ready_timeout", "must be positive")
+
+	check(c.Session.Store == "memory" || c.Session.Store == "file", "session.store", "must be memory or file")
+	check(c.Session.Buffer >= 1, "session.buffer", "must be at least 1")
+
+	return errors.Join(errs...)
+}
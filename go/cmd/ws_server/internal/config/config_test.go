@@ -0,0 +1,77 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ws_server.yaml")
+	err := os.WriteFile(file, []byte(`
+http:
+  addr: ":7000"
+  read_timeout: 3s
+send:
+  queue_size: 8
+admin:
+  token: from-file
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("HTTP_ADDR", ":7001")
+	t.Setenv("SEND_QUEUE_SIZE", "16")
+
+	c, err := Load([]string{"-send.queue-size", "32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP.ReadTimeout != 3*time.Second {
+		t.Errorf("http.read_timeout = %s, want the file's 3s", c.HTTP.ReadTimeout)
+	}
+	if c.HTTP.Addr != ":7001" {
+		t.Errorf("http.addr = %q, want the environment's :7001", c.HTTP.Addr)
+	}
+	if c.Send.QueueSize != 32 {
+		t.Errorf("send.queue_size = %d, want the flag's 32", c.Send.QueueSize)
+	}
+	if c.HTTP.WriteTimeout != Default().HTTP.WriteTimeout {
+		t.Errorf("http.write_timeout = %s, want the default", c.HTTP.WriteTimeout)
+	}
+
+	redacted := c.Redacted()["admin"].(map[string]any)
+	if redacted["token"] != "<redacted>" || redacted["readonly_token"] != "" {
+		t.Errorf("admin settings = %v, want the set token redacted", redacted)
+	}
+}
+
+func TestLoadRejectsUnknownFileKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ws_server.json")
+	if err := os.WriteFile(file, []byte(`{"http": {"adr": ":7000"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load([]string{"-config", file}); err == nil {
+		t.Error("Load accepted a misspelled key")
+	}
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Errorf("Default().Validate() = %v", err)
+	}
+}
+
+func TestProxyProtocolRequiresTrustedCIDRs(t *testing.T) {
+	c := Default()
+	c.ProxyProto.HTTP = "strict"
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() accepted PROXY protocol headers from every source")
+	}
+	c.ProxyProto.TrustedCIDRs = []string{"10.0.0.0/8"}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces the value of secret settings that are set
+const redacted = "<redacted>"
+
+// leaf is a single setting inside Config
+type leaf struct {
+	path  []string
+	field reflect.StructField
+	value reflect.Value
+}
+
+// key is the dotted yaml path, e.g. "http.read_timeout"
+func (l leaf) key() string {
+	return strings.Join(l.path, ".")
+}
+
+// flagName is the key with dashes, e.g. "http.read-timeout"
+func (l leaf) flagName() string {
+	return strings.ReplaceAll(l.key(), "_", "-")
+}
+
+func (l leaf) secret() bool {
+	return l.field.Tag.Get("secret") == "true"
+}
+
+// set parses s into the setting. Lists are comma-separated.
+func (l leaf) set(s string) error {
+	switch v := l.value.Addr().Interface().(type) {
+	case *string:
+		*v = s
+	case *int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		*v = n
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*v = d
+	case *[]string:
+		*v = nil
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*v = append(*v, item)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %s", l.field.Type)
+	}
+	return nil
+}
+
+// display returns the value as it is printed and exposed, with secrets
+// redacted
+func (l leaf) display() any {
+	switch v := l.value.Interface().(type) {
+	case string:
+		if l.secret() && v != "" {
+			return redacted
+		}
+		return v
+	case time.Duration:
+		return v.String()
+	case []string:
+		if v == nil {
+			return []string{}
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// walk calls fn for every setting of c in declaration order
+func walk(c *Config, fn func(leaf)) {
+	var visit func(v reflect.Value, path []string)
+	visit = func(v reflect.Value, path []string) {
+		t := v.Type()
+		for i := range t.NumField() {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			p := append(path[:len(path):len(path)], name)
+			if f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeFor[time.Duration]() {
+				visit(v.Field(i), p)
+				continue
+			}
+			fn(leaf{path: p, field: f, value: v.Field(i)})
+		}
+	}
+	visit(reflect.ValueOf(c).Elem(), nil)
+}
+
+// Load builds the configuration from the defaults, the file named by
+// -config or CONFIG_FILE, the environment and args, in increasing order of
+// precedence, and validates it. It returns flag.ErrHelp when args ask for
+// the usage.
+func Load(args []string) (Config, error) {
+	c := Default()
+
+	fs := flag.NewFlagSet("ws_server", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON configuration `file` (env CONFIG_FILE)")
+	type flagValue struct {
+		leaf  leaf
+		value string
+	}
+	var flags []flagValue
+	walk(&c, func(l leaf) {
+		usage := l.field.Tag.Get("help")
+		if env := l.field.Tag.Get("env"); env != "" {
+			usage += " (env " + env + ")"
+		}
+		fs.Func(l.flagName(), usage, func(s string) error {
+			// Applied after the file and the environment
+			flags = append(flags, flagValue{l, s})
+			return nil
+		})
+	})
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if fs.NArg() > 0 {
+		return c, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	if *file != "" {
+		if err := loadFile(&c, *file); err != nil {
+			return c, err
+		}
+	}
+
+	var errs []error
+	walk(&c, func(l leaf) {
+		env := l.field.Tag.Get("env")
+		if v := os.Getenv(env); env != "" && v != "" {
+			if err := l.set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", env, err))
+			}
+		}
+	})
+	for _, f := range flags {
+		// The flag leaves point into c, which has not moved
+		if err := f.leaf.set(f.value); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %w", f.leaf.flagName(), err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+// loadFile reads settings from a YAML file. JSON files work too, JSON being
+// a subset of YAML. Unknown keys are rejected.
+func loadFile(c *Config, name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", name, err)
+	}
+	return nil
+}
+
+// Redacted returns the settings as nested maps keyed like the file, with
+// durations as strings and secrets redacted
+func (c Config) Redacted() map[string]any {
+	out := map[string]any{}
+	walk(&c, func(l leaf) {
+		m := out
+		for _, p := range l.path[:len(l.path)-1] {
+			if _, ok := m[p]; !ok {
+				m[p] = map[string]any{}
+			}
+			m = m[p].(map[string]any)
+		}
+		m[l.path[len(l.path)-1]] = l.display()
+	})
+	return out
+}
+
+// LogAttrs returns the redacted settings as slog key-value pairs
+func (c Config) LogAttrs() []any {
+	var attrs []any
+	walk(&c, func(l leaf) {
+		attrs = append(attrs, l.key(), l.display())
+	})
+	return attrs
+}
@@ -0,0 +1,73 @@
+package connmanager
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/protocol"
+)
+
+// AdvisoryReason tells the client why it is being disconnected
+type AdvisoryReason string
+
+const (
+	AdviseDrain     AdvisoryReason = "drain"
+	AdviseShutdown  AdvisoryReason = "shutdown"
+	AdviseRebalance AdvisoryReason = "rebalance"
+)
+
+// advisoryPrefix starts the reconnect advisory text message, the JSON
+// encoded Advisory follows it
+const advisoryPrefix = "RECONNECT "
+
+// ReconnectAdvice configures the reconnect advisory sent before a close
+type ReconnectAdvice struct {
+	// Delay is the minimum time the client should wait before reconnecting
+	Delay time.Duration
+	// Jitter is the upper bound of a random delay the client adds to Delay
+	Jitter time.Duration
+	// Spread staggers Delay across the connections closed together, so
+	// they do not reconnect to the other replicas at the same moment
+	Spread time.Duration
+	// Endpoint is an optional URL the client should reconnect to
+	Endpoint string
+}
+
+// Advisory is the reconnect advisory a single client receives
+type Advisory struct {
+	Reason   AdvisoryReason `json:"reason"`
+	DelayMS  int64          `json:"delay_ms"`
+	JitterMS int64          `json:"jitter_ms"`
+	Endpoint string         `json:"endpoint,omitempty"`
+}
+
+// advise returns the advisory for the i-th of n connections closed together
+func (a ReconnectAdvice) advise(reason AdvisoryReason, i, n int) Advisory {
+	delay := a.Delay
+	jitter := a.Jitter
+	if a.Spread > 0 && n > 0 {
+		slot := a.Spread / time.Duration(n)
+		delay += slot * time.Duration(i)
+		// Keep the random part within the slot so neighbours do not overlap
+		jitter = min(jitter, slot)
+	}
+	return Advisory{
+		Reason:   reason,
+		DelayMS:  delay.Milliseconds(),
+		JitterMS: jitter.Milliseconds(),
+		Endpoint: a.Endpoint,
+	}
+}
+
+// message renders the advisory for a connection speaking proto. json.v1
+// clients get it as a shutdown or drain notice.
+func (a Advisory) message(proto string) []byte {
+	if proto == protocol.JSON {
+		if a.Reason == AdviseShutdown {
+			return protocol.Notice(protocol.TypeShutdown, a)
+		}
+		return protocol.Notice(protocol.TypeDrain, a)
+	}
+	data, _ := json.Marshal(a)
+	return append([]byte(advisoryPrefix), data...)
+}
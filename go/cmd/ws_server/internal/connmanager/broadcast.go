@@ -0,0 +1,136 @@
+package connmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+
+	"github.com/ArditZubaku/go-node-ws/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Filter selects the connections a message is delivered to. Empty fields
+// match every connection.
+type Filter struct {
+	ID       string `json:"id,omitempty"`
+	ClientIP string `json:"client_ip,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+}
+
+func (f Filter) Match(c *Connection) bool {
+	return (f.ID == "" || c.ID == f.ID) &&
+		(f.ClientIP == "" || c.ClientIP() == f.ClientIP) &&
+		(f.Path == "" || c.Path == f.Path) &&
+		(f.Tag == "" || slices.Contains(c.Tags, f.Tag))
+}
+
+// BroadcastRequest is an admin message, as accepted by the control port and
+// the HTTP admin endpoint. Exactly one of Message and JSON is set.
+type BroadcastRequest struct {
+	Message string          `json:"message,omitempty"`
+	JSON    json.RawMessage `json:"json,omitempty"`
+	Binary  bool            `json:"binary,omitempty"`
+	Filter
+}
+
+// AdminMessage is the content of a BroadcastRequest, ready to deliver
+type AdminMessage struct {
+	// Type is the WebSocket message type
+	Type int
+	Data []byte
+	// JSON marks Data as a JSON value rather than text
+	JSON bool
+}
+
+// Payload returns the message to send
+func (r BroadcastRequest) Payload() (AdminMessage, error) {
+	switch {
+	case r.Message != "" && len(r.JSON) > 0:
+		return AdminMessage{}, errors.New("set either message or json, not both")
+	case len(r.JSON) > 0 && r.Binary:
+		return AdminMessage{}, errors.New("binary applies to message, not json")
+	case len(r.JSON) > 0:
+		if !json.Valid(r.JSON) {
+			return AdminMessage{}, errors.New("json is not valid JSON")
+		}
+		return AdminMessage{Type: websocket.TextMessage, Data: r.JSON, JSON: true}, nil
+	case r.Message == "":
+		return AdminMessage{}, errors.New("message or json is required")
+	case r.Binary:
+		return AdminMessage{Type: websocket.BinaryMessage, Data: []byte(r.Message)}, nil
+	}
+	return AdminMessage{Type: websocket.TextMessage, Data: []byte(r.Message)}, nil
+}
+
+// Delivery is the result of sending a message to one connection. Delivered
+// means the message was queued for the connection's writer.
+type Delivery struct {
+	ID        string `json:"id"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// DeliveryReport is the outcome of SendTo, per recipient and in total
+type DeliveryReport struct {
+	Delivered  int        `json:"delivered"`
+	Failed     int        `json:"failed"`
+	Recipients []Delivery `json:"recipients"`
+}
+
+func (r *DeliveryReport) add(d Delivery) {
+	if d.Delivered {
+		r.Delivered++
+	} else {
+		r.Failed++
+	}
+	r.Recipients = append(r.Recipients, d)
+}
+
+// SendTo queues a message for every connection f matches and reports the
+// result per recipient. It never waits for a slow consumer: a recipient
+// whose send queue is full has the message dropped and counts as failed.
+func (cm *ConnectionManager) SendTo(f Filter, msg AdminMessage) DeliveryReport {
+	report := DeliveryReport{Recipients: []Delivery{}}
+	if f.ID != "" {
+		// Single recipient, skip the scan
+		if c, ok := cm.GetConnection(f.ID); ok && f.Match(c) {
+			report.add(deliver(c, msg))
+		}
+	} else {
+		for _, c := range cm.Connections() {
+			if f.Match(c) {
+				report.add(deliver(c, msg))
+			}
+		}
+	}
+	slog.Info("Admin message sent", "filter", f, "delivered", report.Delivered, "failed", report.Failed)
+	return report
+}
+
+// AdminTextPrefix starts the text admin messages text.v1 clients receive,
+// telling them apart from replies, which are numbered
+const AdminTextPrefix = "ADMIN: "
+
+// deliver queues a message for c. json.v1 clients get text messages as the
+// payload of a message notice: JSON as it is, text as a string. text.v1
+// clients get text messages after AdminTextPrefix.
+func deliver(c *Connection, msg AdminMessage) Delivery {
+	data := msg.Data
+	if msg.Type == websocket.TextMessage {
+		switch {
+		case c.Protocol != protocol.JSON:
+			data = append([]byte(AdminTextPrefix), data...)
+		case msg.JSON:
+			data = protocol.Notice(protocol.TypeMessage, json.RawMessage(data))
+		default:
+			data = protocol.Notice(protocol.TypeMessage, string(data))
+		}
+	}
+	if err := c.TrySend(msg.Type, data); err != nil {
+		slog.Error("Failed to deliver admin message", "id", c.ID, "error", err)
+		return Delivery{ID: c.ID, Error: err.Error()}
+	}
+	return Delivery{ID: c.ID, Delivered: true}
+}
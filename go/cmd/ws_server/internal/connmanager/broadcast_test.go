@@ -0,0 +1,116 @@
+package connmanager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func TestFilterMatch(t *testing.T) {
+	c := &Connection{
+		ID:           "a1",
+		RemoteAddr:   "10.0.0.2:4000",
+		ForwardedFor: "203.0.113.7, 10.0.0.1",
+		Path:         "/chat",
+		Tags:         []string{"beta", "eu"},
+	}
+	tests := []struct {
+		filter Filter
+		want   bool
+	}{
+		{Filter{}, true},
+		{Filter{ID: "a1"}, true},
+		{Filter{ID: "b2"}, false},
+		{Filter{ClientIP: "203.0.113.7"}, true},
+		{Filter{ClientIP: "10.0.0.2"}, false},
+		{Filter{Path: "/chat", Tag: "eu"}, true},
+		{Filter{Path: "/chat", Tag: "us"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Match(c); got != tt.want {
+			t.Errorf("%+v.Match() = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestBroadcastRequestPayload(t *testing.T) {
+	for _, req := range []BroadcastRequest{
+		{},
+		{Message: "hi", JSON: []byte(`{}`)},
+		{JSON: []byte(`{}`), Binary: true},
+		{JSON: []byte(`{"unterminated"`)},
+	} {
+		if _, err := req.Payload(); err == nil {
+			t.Errorf("Payload() of %+v did not fail", req)
+		}
+	}
+
+	tests := []struct {
+		req  BroadcastRequest
+		want AdminMessage
+	}{
+		{BroadcastRequest{Message: "42"}, AdminMessage{Type: websocket.TextMessage, Data: []byte("42")}},
+		{BroadcastRequest{Message: "hi", Binary: true}, AdminMessage{Type: websocket.BinaryMessage, Data: []byte("hi")}},
+		{BroadcastRequest{JSON: []byte("42")}, AdminMessage{Type: websocket.TextMessage, Data: []byte("42"), JSON: true}},
+	}
+	for _, tt := range tests {
+		got, err := tt.req.Payload()
+		if err != nil || got.Type != tt.want.Type || string(got.Data) != string(tt.want.Data) || got.JSON != tt.want.JSON {
+			t.Errorf("Payload() of %+v = %+v, %v, want %+v", tt.req, got, err, tt.want)
+		}
+	}
+}
+
+// queued returns a connection speaking proto whose writer does not run, so
+// sent messages stay in its queue of size n
+func queued(proto string, n int) *Connection {
+	return &Connection{
+		ID:         "c1",
+		Protocol:   proto,
+		queue:      make(chan outbound, n),
+		writerDone: make(chan struct{}),
+		closing:    make(chan struct{}),
+		send:       SendOptions{Overflow: OverflowBlock, BlockTimeout: time.Minute},
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		proto string
+		msg   AdminMessage
+		want  string
+	}{
+		{protocol.Text, AdminMessage{Type: websocket.TextMessage, Data: []byte("moving soon")}, "ADMIN: moving soon"},
+		{protocol.Text, AdminMessage{Type: websocket.BinaryMessage, Data: []byte("raw")}, "raw"},
+		// Text that happens to be valid JSON stays a string
+		{protocol.JSON, AdminMessage{Type: websocket.TextMessage, Data: []byte("42")}, `{"type":"message","payload":"42"}`},
+		{protocol.JSON, AdminMessage{Type: websocket.TextMessage, Data: []byte("{}")}, `{"type":"message","payload":"{}"}`},
+		{protocol.JSON, AdminMessage{Type: websocket.TextMessage, Data: []byte("42"), JSON: true}, `{"type":"message","payload":42}`},
+	}
+	for _, tt := range tests {
+		c := queued(tt.proto, 1)
+		if d := deliver(c, tt.msg); !d.Delivered {
+			t.Errorf("%s %+v: not delivered: %s", tt.proto, tt.msg, d.Error)
+			continue
+		}
+		if got := <-c.queue; got.messageType != tt.msg.Type || string(got.data) != tt.want {
+			t.Errorf("%s %+v: sent %q, want %q", tt.proto, tt.msg, got.data, tt.want)
+		}
+	}
+}
+
+func TestDeliverDoesNotWaitForFullQueue(t *testing.T) {
+	c := queued(protocol.Text, 1)
+	c.Send(websocket.TextMessage, []byte("queued"))
+
+	start := time.Now()
+	d := deliver(c, AdminMessage{Type: websocket.TextMessage, Data: []byte("hi")})
+	if d.Delivered || d.Error != ErrQueueFull.Error() {
+		t.Errorf("delivery to a full queue: %+v, want it dropped", d)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("delivery to a full queue waited %s", elapsed)
+	}
+}
@@ -0,0 +1,251 @@
+package connmanager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/certs"
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+	"github.com/ArditZubaku/go-node-ws/internal/protocol"
+	"github.com/ArditZubaku/go-node-ws/internal/proxyproto"
+	"github.com/gorilla/websocket"
+)
+
+// Connection is a tracked WebSocket connection together with its metadata.
+// Conn is only read from directly; writes go through Send and SendClose so
+// a single writer goroutine owns the connection.
+type Connection struct {
+	ID           string
+	Conn         *websocket.Conn
+	RemoteAddr   string
+	ForwardedFor string
+	UserAgent    string
+	// Path is the upgrade request path and Tags the values of its repeated
+	// tag query parameter, used to address admin messages
+	Path string
+	Tags []string
+	// Proxy is the PROXY protocol header HAProxy sent, RemoteAddr already
+	// holds its source address
+	Proxy *proxyproto.Header
+	// TLS describes the session when the server terminated TLS
+	TLS *certs.Info
+	// Protocol is the negotiated subprotocol, protocol.Text or protocol.JSON
+	Protocol    string
+	ConnectedAt time.Time
+
+	lastActivity atomic.Int64 // Unix nanoseconds
+	lastInbound  atomic.Int64 // Unix nanoseconds
+	messagesIn   atomic.Uint64
+	messagesOut  atomic.Uint64
+
+	opsMu sync.Mutex
+	ops   map[*Operation]struct{}
+
+	closeOnce      sync.Once
+	closeCode      int
+	closeReason    string
+	closeInitiator Initiator
+
+	resumeToken atomic.Pointer[string]
+
+	send       SendOptions
+	queue      chan outbound
+	stopWriter chan struct{}
+	stopOnce   sync.Once
+	writerDone chan struct{}
+
+	// sendMu is held shared by Send while it queues and exclusively by
+	// SendClose, so no message is queued behind the close frame
+	sendMu      sync.RWMutex
+	closing     chan struct{}
+	closingOnce sync.Once
+	closeQueued bool
+
+	keepalive KeepaliveOptions
+}
+
+// ConnectionInfo is a point-in-time, serializable view of a Connection
+type ConnectionInfo struct {
+	ID           string           `json:"id"`
+	RemoteAddr   string           `json:"remote_addr"`
+	ForwardedFor string           `json:"forwarded_for,omitempty"`
+	UserAgent    string           `json:"user_agent,omitempty"`
+	Path         string           `json:"path,omitempty"`
+	Tags         []string         `json:"tags,omitempty"`
+	Proxy        *proxyproto.Info `json:"proxy,omitempty"`
+	TLS          *certs.Info      `json:"tls,omitempty"`
+	Protocol     string           `json:"protocol"`
+	ConnectedAt  time.Time        `json:"connected_at"`
+	LastActivity time.Time        `json:"last_activity"`
+	MessagesIn   uint64           `json:"messages_in"`
+	MessagesOut  uint64           `json:"messages_out"`
+	InFlight     int              `json:"in_flight"`
+	Queued       int              `json:"queued"`
+}
+
+func newConnection(conn *websocket.Conn, r *http.Request, send SendOptions, keepalive KeepaliveOptions) *Connection {
+	now := time.Now()
+	send = send.withDefaults()
+	c := &Connection{
+		ID:          newConnectionID(),
+		Conn:        conn,
+		RemoteAddr:  conn.RemoteAddr().String(),
+		Proxy:       proxyproto.FromConn(conn.NetConn()),
+		TLS:         certs.InfoOf(conn.NetConn()),
+		Protocol:    protocol.Negotiated(conn.Subprotocol()),
+		ConnectedAt: now,
+		ops:         make(map[*Operation]struct{}),
+		send:        send,
+		queue:       make(chan outbound, max(send.QueueSize, 1)),
+		stopWriter:  make(chan struct{}),
+		writerDone:  make(chan struct{}),
+		closing:     make(chan struct{}),
+		keepalive:   keepalive,
+	}
+	if r != nil {
+		c.ForwardedFor = r.Header.Get("X-Forwarded-For")
+		c.UserAgent = r.UserAgent()
+		if r.URL != nil {
+			c.Path = r.URL.Path
+			c.Tags = r.URL.Query()["tag"]
+		}
+	}
+	c.lastActivity.Store(now.UnixNano())
+	c.lastInbound.Store(now.UnixNano())
+	c.startKeepalive()
+	go c.writeLoop()
+	return c
+}
+
+func newConnectionID() string {
+	b := make([]byte, 8)
+	// crypto/rand.Read never returns an error
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RecordInbound marks a message of size bytes received from the client
+func (c *Connection) RecordInbound(size int) {
+	now := time.Now().UnixNano()
+	c.messagesIn.Add(1)
+	c.lastActivity.Store(now)
+	c.lastInbound.Store(now)
+	c.extendReadDeadline()
+	metrics.Messages.Inc("in")
+	metrics.Bytes.Add(uint64(size), "in")
+}
+
+// recordOutbound marks a message of size bytes sent to the client
+func (c *Connection) recordOutbound(size int) {
+	c.messagesOut.Add(1)
+	c.lastActivity.Store(time.Now().UnixNano())
+	metrics.Messages.Inc("out")
+	metrics.Bytes.Add(uint64(size), "out")
+}
+
+// MarkClosed records why the connection is going away. Only the first call
+// counts, so the side that initiated the close wins.
+func (c *Connection) MarkClosed(code int, reason string, initiator Initiator) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		c.closeInitiator = initiator
+	})
+}
+
+// closeStatus returns the recorded close code, reason and initiator, or an
+// abnormal closure when nobody recorded one
+func (c *Connection) closeStatus() (int, string, Initiator) {
+	c.MarkClosed(websocket.CloseAbnormalClosure, "unknown", InitiatorNetwork)
+	return c.closeCode, c.closeReason, c.closeInitiator
+}
+
+// SetResumeToken sets the session token a drained client can reconnect
+// with. It is sent in the close frame reason.
+func (c *Connection) SetResumeToken(token string) {
+	c.resumeToken.Store(&token)
+}
+
+func (c *Connection) ResumeToken() string {
+	if token := c.resumeToken.Load(); token != nil {
+		return *token
+	}
+	return ""
+}
+
+func (c *Connection) LastActivity() time.Time {
+	return time.Unix(0, c.lastActivity.Load())
+}
+
+func (c *Connection) MessagesIn() uint64 {
+	return c.messagesIn.Load()
+}
+
+func (c *Connection) MessagesOut() uint64 {
+	return c.messagesOut.Load()
+}
+
+// InFlight returns the number of operations currently running on the connection
+func (c *Connection) InFlight() int {
+	c.opsMu.Lock()
+	defer c.opsMu.Unlock()
+	return len(c.ops)
+}
+
+func (c *Connection) operations() []*Operation {
+	c.opsMu.Lock()
+	defer c.opsMu.Unlock()
+	ops := make([]*Operation, 0, len(c.ops))
+	for op := range c.ops {
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// ClientIP returns the originating client address: the source of the PROXY
+// protocol header when HAProxy sent one, which RemoteAddr holds, else the
+// first X-Forwarded-For entry when HAProxy set one, the peer host
+// otherwise. A header only comes from a trusted source, while any client
+// can send X-Forwarded-For.
+func (c *Connection) ClientIP() string {
+	if c.Proxy == nil && c.ForwardedFor != "" {
+		first, _, _ := strings.Cut(c.ForwardedFor, ",")
+		return strings.TrimSpace(first)
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr)
+	if err != nil {
+		return c.RemoteAddr
+	}
+	return host
+}
+
+func (c *Connection) Info() ConnectionInfo {
+	var proxy *proxyproto.Info
+	if c.Proxy != nil {
+		info := c.Proxy.Info()
+		proxy = &info
+	}
+	return ConnectionInfo{
+		ID:           c.ID,
+		RemoteAddr:   c.RemoteAddr,
+		ForwardedFor: c.ForwardedFor,
+		UserAgent:    c.UserAgent,
+		Path:         c.Path,
+		Tags:         c.Tags,
+		Proxy:        proxy,
+		TLS:          c.TLS,
+		Protocol:     c.Protocol,
+		ConnectedAt:  c.ConnectedAt,
+		LastActivity: c.LastActivity(),
+		MessagesIn:   c.MessagesIn(),
+		MessagesOut:  c.MessagesOut(),
+		InFlight:     c.InFlight(),
+		Queued:       c.QueueLen(),
+	}
+}
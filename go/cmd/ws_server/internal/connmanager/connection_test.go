@@ -0,0 +1,28 @@
+package connmanager
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ArditZubaku/go-node-ws/internal/proxyproto"
+)
+
+func TestClientIP(t *testing.T) {
+	proxied := &proxyproto.Header{Version: 2, Source: &net.TCPAddr{IP: net.IPv4(198, 51, 100, 9), Port: 4000}}
+	tests := []struct {
+		conn *Connection
+		want string
+	}{
+		{&Connection{RemoteAddr: "10.0.0.2:4000"}, "10.0.0.2"},
+		{&Connection{RemoteAddr: "10.0.0.2:4000", ForwardedFor: "203.0.113.7, 10.0.0.1"}, "203.0.113.7"},
+		// The header comes from a trusted source, the forwarded header from
+		// anyone
+		{&Connection{RemoteAddr: "198.51.100.9:4000", Proxy: proxied}, "198.51.100.9"},
+		{&Connection{RemoteAddr: "198.51.100.9:4000", ForwardedFor: "203.0.113.7", Proxy: proxied}, "198.51.100.9"},
+	}
+	for _, tt := range tests {
+		if got := tt.conn.ClientIP(); got != tt.want {
+			t.Errorf("ClientIP() of %s forwarded for %q = %q, want %q", tt.conn.RemoteAddr, tt.conn.ForwardedFor, got, tt.want)
+		}
+	}
+}
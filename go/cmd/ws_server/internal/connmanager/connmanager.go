@@ -4,152 +4,405 @@ package connmanager
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"net/http"
 	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
 	"github.com/gorilla/websocket"
 )
 
 // ConnectionManager tracks and manages WebSocket connections
 type ConnectionManager struct {
-	connections []*websocket.Conn
-	mu          sync.RWMutex
-	Shutdown    chan struct{}
+	connections *registry
+
+	// Shutdown is closed when connection handlers should stop
+	Shutdown     chan struct{}
+	shutdownOnce sync.Once
+
+	settingsMu      sync.RWMutex
+	defaultStrategy Strategy
+	closeOptions    CloseOptions
+	sendOptions     SendOptions
+	keepalive       KeepaliveOptions
+	logThreshold    int
+
+	reapedPong atomic.Uint64
+	reapedIdle atomic.Uint64
+
+	events eventBus
+
+	shuttingDown atomic.Bool
+	draining     atomic.Bool
 }
 
 func NewConnectionManager() *ConnectionManager {
+	oldest, _ := StrategyByName(StrategyOldest)
 	return &ConnectionManager{
-		connections: make([]*websocket.Conn, 100),
-		Shutdown:    make(chan struct{}),
+		connections:     newRegistry(),
+		Shutdown:        make(chan struct{}),
+		defaultStrategy: oldest,
+		closeOptions: CloseOptions{
+			Policy:  PolicyInterrupt,
+			Timeout: 30 * time.Second,
+		},
+		sendOptions:  DefaultSendOptions(),
+		keepalive:    DefaultKeepaliveOptions(),
+		logThreshold: 100,
 	}
 }
 
-func (cm *ConnectionManager) AddConnection(conn *websocket.Conn) {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-	cm.connections = append(cm.connections, conn)
-	slog.Info("WebSocket connection added", "total", len(cm.connections))
-	if len(cm.connections) >= 100 {
-		slog.Info("Reached 100 WebSocket connections")
+// MarkShuttingDown records that the server received a termination signal.
+// From then on the server reports itself as draining.
+func (cm *ConnectionManager) MarkShuttingDown() {
+	cm.shuttingDown.Store(true)
+}
+
+func (cm *ConnectionManager) ShuttingDown() bool {
+	return cm.shuttingDown.Load()
+}
+
+// SetDraining records whether a drain plan took the server out of rotation
+func (cm *ConnectionManager) SetDraining(draining bool) {
+	cm.draining.Store(draining)
+}
+
+// Draining reports whether the server wants to stop receiving new
+// connections, either because of a drain plan or because it is shutting down
+func (cm *ConnectionManager) Draining() bool {
+	return cm.draining.Load() || cm.shuttingDown.Load()
+}
+
+// SetDefaultStrategy sets the strategy used when a drain does not name one
+func (cm *ConnectionManager) SetDefaultStrategy(s Strategy) {
+	cm.settingsMu.Lock()
+	defer cm.settingsMu.Unlock()
+	cm.defaultStrategy = s
+}
+
+func (cm *ConnectionManager) DefaultStrategy() Strategy {
+	cm.settingsMu.RLock()
+	defer cm.settingsMu.RUnlock()
+	return cm.defaultStrategy
+}
+
+// SetSendOptions sets the outbound queue settings of new connections
+func (cm *ConnectionManager) SetSendOptions(opts SendOptions) {
+	cm.settingsMu.Lock()
+	defer cm.settingsMu.Unlock()
+	cm.sendOptions = opts
+}
+
+func (cm *ConnectionManager) SendOptions() SendOptions {
+	cm.settingsMu.RLock()
+	defer cm.settingsMu.RUnlock()
+	return cm.sendOptions
+}
+
+// SetKeepaliveOptions sets the ping and idle settings of new connections
+func (cm *ConnectionManager) SetKeepaliveOptions(opts KeepaliveOptions) {
+	cm.settingsMu.Lock()
+	defer cm.settingsMu.Unlock()
+	cm.keepalive = opts
+}
+
+func (cm *ConnectionManager) KeepaliveOptions() KeepaliveOptions {
+	cm.settingsMu.RLock()
+	defer cm.settingsMu.RUnlock()
+	return cm.keepalive
+}
+
+// SetLogThreshold sets the connection count that is logged when it is
+// reached, zero disables the message
+func (cm *ConnectionManager) SetLogThreshold(n int) {
+	cm.settingsMu.Lock()
+	defer cm.settingsMu.Unlock()
+	cm.logThreshold = n
+}
+
+func (cm *ConnectionManager) LogThreshold() int {
+	cm.settingsMu.RLock()
+	defer cm.settingsMu.RUnlock()
+	return cm.logThreshold
+}
+
+// ReapedCounts reports how many connections the keepalive closed, by reason
+type ReapedCounts struct {
+	PongTimeout uint64 `json:"pong_timeout"`
+	IdleTimeout uint64 `json:"idle_timeout"`
+}
+
+func (cm *ConnectionManager) Reaped() ReapedCounts {
+	return ReapedCounts{
+		PongTimeout: cm.reapedPong.Load(),
+		IdleTimeout: cm.reapedIdle.Load(),
 	}
 }
 
-func (cm *ConnectionManager) RemoveConnection(conn *websocket.Conn) {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-	cm.connections = slices.DeleteFunc(
-		cm.connections,
-		func(c *websocket.Conn) bool {
-			return c == conn
-		},
+// AddConnection registers conn, starts its writer and returns its tracking
+// record. r is the upgrade request the connection metadata is taken from and
+// may be nil.
+func (cm *ConnectionManager) AddConnection(conn *websocket.Conn, r *http.Request) *Connection {
+	c := newConnection(conn, r, cm.SendOptions(), cm.KeepaliveOptions())
+
+	metrics.ConnectionsAccepted.Inc()
+
+	total := cm.connections.add(c)
+	slog.Info(
+		"WebSocket connection added",
+		"id", c.ID,
+		"remote_addr", c.RemoteAddr,
+		"forwarded_for", c.ForwardedFor,
+		"proxied", c.Proxy != nil,
+		"tls", c.TLS != nil,
+		"protocol", c.Protocol,
+		"total", total,
 	)
-	slog.Info("WebSocket connection removed", "total", len(cm.connections))
+	if threshold := cm.LogThreshold(); threshold > 0 && total == threshold {
+		slog.Info("Reached WebSocket connection threshold", "total", total)
+	}
+	cm.Publish(Event{Type: EventConnected, ConnectionID: c.ID, Remaining: total})
+	return c
+}
+
+func (cm *ConnectionManager) RemoveConnection(c *Connection) {
+	cm.RemoveConnectionByID(c.ID)
+}
+
+// RemoveConnectionByID stops tracking the connection with the given ID and
+// reports whether it was tracked
+func (cm *ConnectionManager) RemoveConnectionByID(id string) bool {
+	removed, total := cm.connections.remove(id)
+	if removed == nil {
+		return false
+	}
+
+	code, reason, initiator := removed.closeStatus()
+	metrics.ConnectionsClosed.Inc(strconv.Itoa(code), reason)
+	switch reason {
+	case ReasonPongTimeout:
+		cm.reapedPong.Add(1)
+		metrics.ConnectionsReaped.Inc("pong_timeout")
+	case ReasonIdleTimeout:
+		cm.reapedIdle.Add(1)
+		metrics.ConnectionsReaped.Inc("idle_timeout")
+	}
+	slog.Info("WebSocket connection removed", "id", id, "code", code, "reason", reason, "initiator", initiator, "total", total)
+	cm.Publish(Event{
+		Type:         EventDisconnected,
+		ConnectionID: id,
+		Code:         code,
+		Reason:       reason,
+		Initiator:    initiator,
+		Remaining:    total,
+	})
+	return true
 }
 
-func (cm *ConnectionManager) RemoveConnectionByIndex(index int) {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-	cm.connections = slices.Delete(cm.connections, index, index+1)
-	slog.Info("WebSocket connection removed", "total", len(cm.connections))
+func (cm *ConnectionManager) GetConnection(id string) (*Connection, bool) {
+	return cm.connections.get(id)
 }
 
-func (cm *ConnectionManager) GetFirstNConnections(n int) []*websocket.Conn {
-	cm.mu.RLock()
-	defer cm.mu.RUnlock()
+// Connections returns a snapshot of all tracked connections in the order
+// they were added. The snapshot is shared with other callers and must not
+// be modified.
+func (cm *ConnectionManager) Connections() []*Connection {
+	return cm.connections.snapshot()
+}
 
-	connections := make([]*websocket.Conn, n)
-	copy(connections, cm.connections[:min(n, len(cm.connections))])
+// Range calls fn for every tracked connection until fn returns false.
+// It iterates over a snapshot, so fn may add or remove connections.
+func (cm *ConnectionManager) Range(fn func(c *Connection) bool) {
+	for _, c := range cm.Connections() {
+		if !fn(c) {
+			return
+		}
+	}
+}
 
-	return connections
+func (cm *ConnectionManager) GetFirstNConnections(n int) []*Connection {
+	connections := cm.Connections()
+	return slices.Clone(connections[:min(max(n, 0), len(connections))])
 }
 
 func (cm *ConnectionManager) GetConnectionsCount() int {
-	cm.mu.RLock()
-	defer cm.mu.RUnlock()
+	return cm.connections.len()
+}
 
-	return len(cm.connections)
+// CloseFirstNConnections closes n connections picked by the default strategy
+func (cm *ConnectionManager) CloseFirstNConnections(n int) int {
+	return cm.CloseNConnections(n, cm.DefaultStrategy(), CloseOptions{})
 }
 
-func (cm *ConnectionManager) CloseFirstNConnections(n int) {
-	connections := cm.GetFirstNConnections(n)
+// CloseNConnections closes up to n connections picked by s and returns how
+// many were closed. A nil s uses the default strategy. Connections are closed
+// concurrently so waiting for in-flight operations on one does not hold up
+// the others.
+func (cm *ConnectionManager) CloseNConnections(n int, s Strategy, opts CloseOptions) int {
+	if s == nil {
+		s = cm.DefaultStrategy()
+	}
+	opts = cm.withDefaults(opts)
+	connections := s.Select(cm.Connections(), n)
 
-	slog.Info("Closing WebSocket connections", "count", len(connections))
+	slog.Info(
+		"Closing WebSocket connections",
+		"count", len(connections),
+		"strategy", s.Name(),
+		"in_flight_policy", opts.Policy,
+	)
 
-	for i, conn := range connections {
-		// Send close message
-		if err := conn.WriteMessage(
-			websocket.CloseMessage,
-			websocket.FormatCloseMessage(
-				websocket.CloseGoingAway,
-				"Server shutting down",
-			),
-		); err != nil {
-			slog.Error("Error sending close message", "error", err)
-		}
+	var wg sync.WaitGroup
+	for i, c := range connections {
+		advisory := opts.Reconnect.advise(AdviseDrain, i, len(connections))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cm.closeConnection(c, opts, "server drain", advisory)
+		}()
+	}
+	wg.Wait()
+	return len(connections)
+}
+
+// CloseConnection closes the connection with the given ID and reports
+// whether it was tracked
+func (cm *ConnectionManager) CloseConnection(id string, opts CloseOptions) bool {
+	c, ok := cm.GetConnection(id)
+	if !ok {
+		return false
+	}
+	opts = cm.withDefaults(opts)
+	cm.closeConnection(c, opts, "admin kick", opts.Reconnect.advise(AdviseRebalance, 0, 1))
+	return true
+}
 
-		if err := conn.Close(); err != nil {
-			slog.Error("Error closing WebSocket connection", "error", err)
+// closeConnection settles c's in-flight operations according to opts, then
+// sends the reconnect advisory and a close frame and closes it. reason is
+// reported to interrupted operations.
+func (cm *ConnectionManager) closeConnection(c *Connection, opts CloseOptions, reason string, advisory Advisory) {
+	cm.settleOperations(c, opts, reason)
+	c.MarkClosed(websocket.CloseGoingAway, reason, InitiatorServer)
+
+	// Tell the client when and where to reconnect
+	if err := c.Send(websocket.TextMessage, advisory.message(c.Protocol)); err != nil {
+		slog.Error("Error sending reconnect advisory", "id", c.ID, "error", err)
+	}
+
+	// Send close message, with the resume token when the connection has a
+	// session
+	closeReason := "Server shutting down"
+	if token := c.ResumeToken(); token != "" {
+		closeReason += "; resume=" + token
+	}
+	outcome := CloseClean
+	if err := c.SendClose(websocket.CloseGoingAway, closeReason); err != nil {
+		outcome = CloseFailed
+		if errors.Is(err, ErrConnectionClosed) {
+			outcome = CloseGone
 		}
+		slog.Error("Error sending close message", "id", c.ID, "error", err)
+	}
 
-		// Remove from array
-		cm.RemoveConnectionByIndex(i)
+	if err := c.Close(); err != nil {
+		slog.Error("Error closing WebSocket connection", "id", c.ID, "error", err)
 	}
+
+	cm.RemoveConnection(c)
+	if opts.Tally != nil {
+		opts.Tally.Add(outcome)
+	}
+	cm.Publish(Event{
+		Type:         EventCloseResult,
+		CommandID:    opts.CommandID,
+		ConnectionID: c.ID,
+		Code:         websocket.CloseGoingAway,
+		Reason:       reason,
+		Outcome:      outcome,
+		Remaining:    cm.GetConnectionsCount(),
+	})
 }
 
+// CloseAllConnections signals shutdown to all connection handlers, sends
+// every connection a close frame and waits until they are all removed or ctx
+// expires
 func (cm *ConnectionManager) CloseAllConnections(ctx context.Context) {
-	cm.mu.RLock()
-	defer cm.mu.RUnlock()
+	connections := cm.Connections()
 
-	slog.Info("Closing all WebSocket connections", "count", len(cm.connections))
+	slog.Info("Closing all WebSocket connections", "count", len(connections))
 
 	// Signal shutdown to all connections
-	close(cm.Shutdown)
-
-	// Close all connections gracefully
-	for i, conn := range cm.connections {
-		// Send close message
-		if err := conn.WriteMessage(
-			websocket.CloseMessage,
-			websocket.FormatCloseMessage(
-				websocket.CloseGoingAway,
-				"Server shutting down",
-			),
-		); err != nil {
-			slog.Error("Error sending close message", "error", err)
-		}
-
-		if err := conn.Close(); err != nil {
-			slog.Error("Error closing WebSocket connection", "error", err)
-		}
+	cm.signalShutdown()
 
-		// Remove from array
-		cm.RemoveConnectionByIndex(i)
+	// Close all connections gracefully. Waiting for in-flight operations is
+	// the shutdown orchestrator's job, anything still running is interrupted.
+	opts := cm.withDefaults(CloseOptions{Policy: PolicyInterrupt})
+	var wg sync.WaitGroup
+	for i, c := range connections {
+		advisory := opts.Reconnect.advise(AdviseShutdown, i, len(connections))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cm.closeConnection(c, opts, "server shutdown", advisory)
+		}()
 	}
+	wg.Wait()
 
 	// Wait for all connections to be removed or timeout
-	timeout := time.NewTimer(5 * time.Second)
 	ticker := time.NewTicker(100 * time.Millisecond)
-	defer timeout.Stop()
 	defer ticker.Stop()
 
 	for {
+		if cm.GetConnectionsCount() == 0 {
+			slog.Info("All WebSocket connections closed")
+			return
+		}
 		select {
 		case <-ctx.Done():
-			slog.Warn("Context cancelled while waiting for WebSocket connections to close")
-			return
-		case <-timeout.C:
-			slog.Warn("Timeout waiting for WebSocket connections to close")
+			slog.Warn("Timeout waiting for WebSocket connections to close", "remaining", cm.GetConnectionsCount())
 			return
 		case <-ticker.C:
-			cm.mu.RLock()
-			count := len(cm.connections)
-			cm.mu.RUnlock()
-			if count == 0 {
-				slog.Info("All WebSocket connections closed")
-				return
-			}
 		}
 	}
 }
+
+// ForceCloseAll closes the underlying network connection of every remaining
+// connection without a close handshake
+func (cm *ConnectionManager) ForceCloseAll() {
+	cm.signalShutdown()
+
+	connections := cm.Connections()
+	if len(connections) == 0 {
+		return
+	}
+	slog.Warn("Force closing WebSocket connections", "count", len(connections))
+
+	for _, c := range connections {
+		c.MarkClosed(websocket.CloseAbnormalClosure, "force close", InitiatorServer)
+		if err := c.Close(); err != nil {
+			slog.Error("Error force closing WebSocket connection", "id", c.ID, "error", err)
+		}
+		cm.RemoveConnection(c)
+	}
+}
+
+// InFlightCount returns the number of operations running across all
+// connections
+func (cm *ConnectionManager) InFlightCount() int {
+	total := 0
+	for _, c := range cm.Connections() {
+		total += c.InFlight()
+	}
+	return total
+}
+
+func (cm *ConnectionManager) signalShutdown() {
+	cm.shutdownOnce.Do(func() {
+		close(cm.Shutdown)
+	})
+}
@@ -0,0 +1,193 @@
+package connmanager
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+)
+
+// EventType identifies a lifecycle event
+type EventType string
+
+const (
+	EventConnected        EventType = "connected"
+	EventDisconnected     EventType = "disconnected"
+	EventDrainStarted     EventType = "drain_started"
+	EventDrainProgress    EventType = "drain_progress"
+	EventDrainFinished    EventType = "drain_finished"
+	EventShutdownPhase    EventType = "shutdown_phase"
+	EventOperationStarted EventType = "operation_started"
+	EventOperationEnded   EventType = "operation_ended"
+	// EventCloseResult reports whether a server-initiated close reached the
+	// client, see CloseOutcome
+	EventCloseResult EventType = "close_result"
+)
+
+// CloseOutcome is the result of a server-initiated close
+type CloseOutcome string
+
+const (
+	// CloseClean means the close frame was written
+	CloseClean CloseOutcome = "clean"
+	// CloseFailed means the close frame could not be written
+	CloseFailed CloseOutcome = "failed"
+	// CloseGone means the connection was already gone
+	CloseGone CloseOutcome = "gone"
+)
+
+// CloseTally counts the outcomes of the closes made with the CloseOptions
+// it is set on. It is exact, unlike counting close results from the event
+// bus, which drops events for slow subscribers. Safe for concurrent use.
+type CloseTally struct {
+	clean, failed, gone atomic.Int64
+}
+
+// Add counts one close with outcome o
+func (t *CloseTally) Add(o CloseOutcome) {
+	switch o {
+	case CloseClean:
+		t.clean.Add(1)
+	case CloseFailed:
+		t.failed.Add(1)
+	case CloseGone:
+		t.gone.Add(1)
+	}
+}
+
+// Counts returns the closes counted so far by outcome
+func (t *CloseTally) Counts() (clean, failed, gone int) {
+	return int(t.clean.Load()), int(t.failed.Load()), int(t.gone.Load())
+}
+
+// Initiator tells which side ended a connection
+type Initiator string
+
+const (
+	InitiatorClient  Initiator = "client"
+	InitiatorServer  Initiator = "server"
+	InitiatorNetwork Initiator = "network"
+)
+
+// Event is a lifecycle notification. Only the fields relevant to its Type
+// are set, the code and counts are always encoded since zero is a value
+// worth reporting, e.g. no connections remaining.
+type Event struct {
+	Type EventType `json:"type"`
+	At   time.Time `json:"at"`
+
+	// CommandID names the command that caused the event, see
+	// CloseOptions.CommandID
+	CommandID    string       `json:"command_id,omitempty"`
+	ConnectionID string       `json:"connection_id,omitempty"`
+	Code         int          `json:"code"`
+	Reason       string       `json:"reason,omitempty"`
+	Initiator    Initiator    `json:"initiator,omitempty"`
+	Operation    string       `json:"operation,omitempty"`
+	Outcome      CloseOutcome `json:"outcome,omitempty"`
+
+	Plan      string `json:"plan,omitempty"`
+	State     string `json:"state,omitempty"`
+	Closed    int    `json:"closed"`
+	Remaining int    `json:"remaining"`
+
+	Phase         string `json:"phase,omitempty"`
+	PreviousPhase string `json:"previous_phase,omitempty"`
+}
+
+// defaultEventBuffer is the channel size of subscriptions that do not ask
+// for one
+const defaultEventBuffer = 256
+
+// Subscription receives published events on C. Events that do not fit in
+// the buffer are dropped rather than blocking the publisher.
+type Subscription struct {
+	C <-chan Event
+
+	bus     *eventBus
+	ch      chan Event
+	types   []EventType
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Dropped returns the number of events lost because the subscriber fell
+// behind
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close stops the subscription and closes C
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mu.Unlock()
+		close(s.ch)
+	})
+}
+
+func (s *Subscription) wants(t EventType) bool {
+	return len(s.types) == 0 || slices.Contains(s.types, t)
+}
+
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscribe returns a subscription to events of the given types, or to all
+// events when none are given. buffer sizes the channel, zero picks a default.
+func (cm *ConnectionManager) Subscribe(buffer int, types ...EventType) *Subscription {
+	if buffer <= 0 {
+		buffer = defaultEventBuffer
+	}
+	ch := make(chan Event, buffer)
+	s := &Subscription{C: ch, bus: &cm.events, ch: ch, types: types}
+
+	cm.events.mu.Lock()
+	defer cm.events.mu.Unlock()
+	if cm.events.subs == nil {
+		cm.events.subs = make(map[*Subscription]struct{})
+	}
+	cm.events.subs[s] = struct{}{}
+	return s
+}
+
+// SubscribeFunc calls fn for every event of the given types on a goroutine
+// of its own, until the returned subscription is closed
+func (cm *ConnectionManager) SubscribeFunc(fn func(Event), types ...EventType) *Subscription {
+	s := cm.Subscribe(0, types...)
+	go func() {
+		for e := range s.C {
+			fn(e)
+		}
+	}()
+	return s
+}
+
+// Publish delivers e to every interested subscriber without blocking
+func (cm *ConnectionManager) Publish(e Event) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+
+	cm.events.mu.RLock()
+	defer cm.events.mu.RUnlock()
+	for s := range cm.events.subs {
+		if !s.wants(e.Type) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			if s.dropped.Add(1) == 1 {
+				slog.Warn("Event subscriber is falling behind, dropping events", "type", e.Type)
+			}
+			metrics.EventsDropped.Inc()
+		}
+	}
+}
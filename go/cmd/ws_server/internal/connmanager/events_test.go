@@ -0,0 +1,56 @@
+package connmanager
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPublishDoesNotBlockOnSlowSubscriber(t *testing.T) {
+	cm := NewConnectionManager()
+	slow := cm.Subscribe(1)
+	defer slow.Close()
+
+	for range 3 {
+		cm.Publish(Event{Type: EventConnected})
+	}
+
+	if got := slow.Dropped(); got != 2 {
+		t.Errorf("Dropped() = %d, want 2", got)
+	}
+	if e := <-slow.C; e.Type != EventConnected || e.At.IsZero() {
+		t.Errorf("received %+v, want a timestamped connected event", e)
+	}
+}
+
+func TestSubscribeFiltersByType(t *testing.T) {
+	cm := NewConnectionManager()
+	sub := cm.Subscribe(4, EventDrainFinished)
+
+	cm.Publish(Event{Type: EventConnected})
+	cm.Publish(Event{Type: EventDrainFinished, State: "completed"})
+	sub.Close()
+
+	var got []Event
+	for e := range sub.C {
+		got = append(got, e)
+	}
+	if len(got) != 1 || got[0].Type != EventDrainFinished {
+		t.Errorf("received %+v, want only the drain_finished event", got)
+	}
+
+	// Publishing after Close must not panic on the closed channel
+	cm.Publish(Event{Type: EventDrainFinished})
+}
+
+func TestEventEncodesZeroCounts(t *testing.T) {
+	data, err := json.Marshal(Event{Type: EventDrainFinished, State: "completed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"code":0`, `"closed":0`, `"remaining":0`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("%s lacks %s", data, field)
+		}
+	}
+}
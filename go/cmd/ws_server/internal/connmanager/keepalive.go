@@ -0,0 +1,127 @@
+package connmanager
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close reasons of connections reaped by the keepalive
+const (
+	ReasonPongTimeout = "pong timeout"
+	ReasonIdleTimeout = "idle timeout"
+)
+
+// KeepaliveOptions configures dead-peer detection for new connections.
+// Keep PingInterval below HAProxy's "timeout tunnel", so the pings also keep
+// the proxied connection open.
+type KeepaliveOptions struct {
+	// PingInterval is how often the server pings, zero disables pings and
+	// read deadlines
+	PingInterval time.Duration
+	// PongTimeout is how long after a ping is due the server waits for any
+	// frame from the client before it considers the peer dead
+	PongTimeout time.Duration
+	// IdleTimeout closes connections that sent no application message for
+	// this long, zero disables it
+	IdleTimeout time.Duration
+}
+
+func DefaultKeepaliveOptions() KeepaliveOptions {
+	return KeepaliveOptions{
+		PingInterval: 30 * time.Second,
+		PongTimeout:  10 * time.Second,
+	}
+}
+
+// readWait is how long a read may block before the peer is considered dead
+func (k KeepaliveOptions) readWait() time.Duration {
+	return k.PingInterval + k.PongTimeout
+}
+
+// startKeepalive arms the read deadline and extends it on every pong. It
+// must run before the handler starts reading.
+func (c *Connection) startKeepalive() {
+	if c.keepalive.PingInterval <= 0 {
+		return
+	}
+	_ = c.Conn.SetReadDeadline(time.Now().Add(c.keepalive.readWait()))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(c.keepalive.readWait()))
+	})
+}
+
+// extendReadDeadline is called for every application message, any frame
+// from the client proves it is alive
+func (c *Connection) extendReadDeadline() {
+	if c.keepalive.PingInterval > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.keepalive.readWait()))
+	}
+}
+
+// Handled is called when the handler finished a message. Control frames,
+// pongs included, are only read between messages, so the time spent
+// handling one counts neither against the pong timeout nor as idle time.
+func (c *Connection) Handled() {
+	c.lastInbound.Store(time.Now().UnixNano())
+	c.extendReadDeadline()
+}
+
+// MarkReadError records the close status for a read that ended the
+// connection: the client's close code, a pong timeout or a broken read
+func (c *Connection) MarkReadError(err error) {
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &closeErr):
+		c.MarkClosed(closeErr.Code, "client", InitiatorClient)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		slog.Info("WebSocket peer stopped responding", "id", c.ID, "timeout", c.keepalive.readWait())
+		c.MarkClosed(websocket.CloseAbnormalClosure, ReasonPongTimeout, InitiatorServer)
+	default:
+		c.MarkClosed(websocket.CloseAbnormalClosure, "read error", InitiatorNetwork)
+	}
+}
+
+// idle reports whether the client has not sent an application message for
+// longer than the idle timeout. A client waiting for a running operation is
+// not idle.
+func (c *Connection) idle(now time.Time) bool {
+	timeout := c.keepalive.IdleTimeout
+	return timeout > 0 && now.Sub(time.Unix(0, c.lastInbound.Load())) > timeout && c.InFlight() == 0
+}
+
+// tickInterval is how often the writer pings and checks for idleness
+func (k KeepaliveOptions) tickInterval() time.Duration {
+	switch {
+	case k.PingInterval > 0 && k.IdleTimeout > 0:
+		return min(k.PingInterval, k.IdleTimeout)
+	case k.PingInterval > 0:
+		return k.PingInterval
+	case k.IdleTimeout > 0:
+		return k.IdleTimeout
+	}
+	return 0
+}
+
+// keepaliveTick runs on the writer goroutine and reports whether the
+// connection was closed
+func (c *Connection) keepaliveTick(now time.Time) bool {
+	if c.idle(now) {
+		slog.Info("Closing idle WebSocket connection", "id", c.ID, "idle_timeout", c.keepalive.IdleTimeout)
+		c.MarkClosed(websocket.CloseGoingAway, ReasonIdleTimeout, InitiatorServer)
+		_ = c.Conn.SetWriteDeadline(now.Add(c.send.WriteTimeout))
+		_ = c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Idle timeout"))
+		c.Close()
+		return true
+	}
+	if c.keepalive.PingInterval > 0 {
+		if err := c.Conn.WriteControl(websocket.PingMessage, nil, now.Add(c.send.WriteTimeout)); err != nil {
+			slog.Debug("Failed to ping WebSocket peer", "id", c.ID, "error", err)
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package connmanager
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+)
+
+// InFlightPolicy decides what happens to running operations when their
+// connection is closed
+type InFlightPolicy string
+
+const (
+	// PolicyWait lets operations finish, up to CloseOptions.Timeout, and
+	// interrupts whatever is still running after that
+	PolicyWait InFlightPolicy = "wait"
+	// PolicyInterrupt interrupts operations right away
+	PolicyInterrupt InFlightPolicy = "interrupt"
+)
+
+// interruptAckTimeout is how long an interrupted operation gets to reply to
+// its client before the connection is closed underneath it
+const interruptAckTimeout = time.Second
+
+func ParseInFlightPolicy(s string) (InFlightPolicy, error) {
+	switch p := InFlightPolicy(s); p {
+	case PolicyWait, PolicyInterrupt:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown in-flight policy %q", s)
+}
+
+// CloseOptions controls how connections with running operations are closed.
+// Zero fields fall back to the ConnectionManager defaults.
+type CloseOptions struct {
+	Policy    InFlightPolicy
+	Timeout   time.Duration
+	Reconnect ReconnectAdvice
+	// CommandID is published on the close results, so a watch can tell the
+	// closes of its command from the others
+	CommandID string
+	// Tally, when set, counts the outcome of every close
+	Tally *CloseTally
+}
+
+// Operation is a long-running unit of work on a connection, such as a slow
+// request. Handlers must call End when it finishes and should stop early
+// when Interrupted is closed.
+type Operation struct {
+	Name      string
+	StartedAt time.Time
+
+	cm        *ConnectionManager
+	conn      *Connection
+	interrupt chan struct{}
+	done      chan struct{}
+	once      sync.Once
+	endOnce   sync.Once
+	reason    string
+}
+
+// BeginOperation registers a running operation on c
+func (cm *ConnectionManager) BeginOperation(c *Connection, name string) *Operation {
+	op := &Operation{
+		Name:      name,
+		StartedAt: time.Now(),
+		cm:        cm,
+		conn:      c,
+		interrupt: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	c.opsMu.Lock()
+	c.ops[op] = struct{}{}
+	c.opsMu.Unlock()
+	metrics.SlowOperations.Inc("started")
+	slog.Debug("Operation started", "id", c.ID, "operation", name)
+	cm.Publish(Event{Type: EventOperationStarted, ConnectionID: c.ID, Operation: name})
+	return op
+}
+
+// End marks the operation as finished. It is safe to call more than once.
+func (op *Operation) End() {
+	op.endOnce.Do(func() {
+		op.conn.opsMu.Lock()
+		delete(op.conn.ops, op)
+		op.conn.opsMu.Unlock()
+		close(op.done)
+		reason := op.Reason()
+		if reason != "" {
+			metrics.SlowOperations.Inc("interrupted")
+		} else {
+			metrics.SlowOperations.Inc("completed")
+		}
+		slog.Debug("Operation ended", "id", op.conn.ID, "operation", op.Name, "elapsed", time.Since(op.StartedAt))
+		op.cm.Publish(Event{Type: EventOperationEnded, ConnectionID: op.conn.ID, Operation: op.Name, Reason: reason})
+	})
+}
+
+// Interrupted is closed when the operation should stop early
+func (op *Operation) Interrupted() <-chan struct{} {
+	return op.interrupt
+}
+
+// Reason explains why the operation was interrupted
+func (op *Operation) Reason() string {
+	select {
+	case <-op.interrupt:
+		return op.reason
+	default:
+		return ""
+	}
+}
+
+func (op *Operation) Interrupt(reason string) {
+	op.once.Do(func() {
+		op.reason = reason
+		close(op.interrupt)
+	})
+}
+
+// Done is closed once End was called
+func (op *Operation) Done() <-chan struct{} {
+	return op.done
+}
+
+// SetCloseOptions sets the default in-flight handling for closes
+func (cm *ConnectionManager) SetCloseOptions(opts CloseOptions) {
+	cm.settingsMu.Lock()
+	defer cm.settingsMu.Unlock()
+	cm.closeOptions = opts
+}
+
+func (cm *ConnectionManager) CloseOptions() CloseOptions {
+	cm.settingsMu.RLock()
+	defer cm.settingsMu.RUnlock()
+	return cm.closeOptions
+}
+
+func (cm *ConnectionManager) withDefaults(opts CloseOptions) CloseOptions {
+	def := cm.CloseOptions()
+	if opts.Policy == "" {
+		opts.Policy = def.Policy
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = def.Timeout
+	}
+	if opts.Reconnect.Delay == 0 {
+		opts.Reconnect.Delay = def.Reconnect.Delay
+	}
+	if opts.Reconnect.Jitter == 0 {
+		opts.Reconnect.Jitter = def.Reconnect.Jitter
+	}
+	if opts.Reconnect.Spread == 0 {
+		opts.Reconnect.Spread = def.Reconnect.Spread
+	}
+	if opts.Reconnect.Endpoint == "" {
+		opts.Reconnect.Endpoint = def.Reconnect.Endpoint
+	}
+	return opts
+}
+
+// settleOperations applies the in-flight policy to c's running operations
+// and returns once they have all ended or their deadlines have passed
+func (cm *ConnectionManager) settleOperations(c *Connection, opts CloseOptions, reason string) {
+	ops := c.operations()
+	if len(ops) == 0 {
+		return
+	}
+
+	if opts.Policy == PolicyWait && opts.Timeout > 0 {
+		slog.Info("Waiting for in-flight operations before close", "id", c.ID, "count", len(ops), "timeout", opts.Timeout)
+		if waitOperations(ops, opts.Timeout) {
+			return
+		}
+		slog.Warn("In-flight operations did not finish in time, interrupting", "id", c.ID)
+	}
+
+	for _, op := range ops {
+		op.Interrupt(reason)
+	}
+	// Give interrupted handlers a moment to tell their client
+	waitOperations(ops, interruptAckTimeout)
+}
+
+// InterruptAll interrupts every running operation on every connection
+func (cm *ConnectionManager) InterruptAll(reason string) {
+	for _, c := range cm.Connections() {
+		for _, op := range c.operations() {
+			op.Interrupt(reason)
+		}
+	}
+}
+
+// waitOperations reports whether all ops ended within timeout
+func waitOperations(ops []*Operation, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for _, op := range ops {
+		select {
+		case <-op.Done():
+		case <-deadline.C:
+			return false
+		}
+	}
+	return true
+}
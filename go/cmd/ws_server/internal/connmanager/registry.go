@@ -0,0 +1,89 @@
+package connmanager
+
+import (
+	"container/list"
+	"sync"
+)
+
+// registry indexes connections by ID and keeps them in the order they were
+// added. Add, remove and lookup are O(1). Snapshots are built once per change
+// and shared between readers until the next add or remove.
+type registry struct {
+	mu    sync.RWMutex
+	byID  map[string]*list.Element
+	order *list.List // of *Connection, oldest first
+
+	// cached is the current snapshot, nil after a change
+	cached []*Connection
+}
+
+func newRegistry() *registry {
+	return &registry{
+		byID:  make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// add registers c and returns the new total
+func (r *registry) add(c *Connection) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byID[c.ID]; ok {
+		return len(r.byID)
+	}
+	r.byID[c.ID] = r.order.PushBack(c)
+	r.cached = nil
+	return len(r.byID)
+}
+
+// remove unregisters the connection with the given ID and returns it along
+// with the new total, or nil when it was not registered
+func (r *registry) remove(id string) (*Connection, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.byID[id]
+	if !ok {
+		return nil, len(r.byID)
+	}
+	delete(r.byID, id)
+	r.order.Remove(e)
+	r.cached = nil
+	return e.Value.(*Connection), len(r.byID)
+}
+
+func (r *registry) get(id string) (*Connection, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.byID[id]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*Connection), true
+}
+
+func (r *registry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.byID)
+}
+
+// snapshot returns the registered connections in the order they were added.
+// The slice is shared and must not be modified.
+func (r *registry) snapshot() []*Connection {
+	r.mu.RLock()
+	cached := r.cached
+	r.mu.RUnlock()
+	if cached != nil {
+		return cached
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cached == nil {
+		r.cached = make([]*Connection, 0, r.order.Len())
+		for e := r.order.Front(); e != nil; e = e.Next() {
+			r.cached = append(r.cached, e.Value.(*Connection))
+		}
+	}
+	return r.cached
+}
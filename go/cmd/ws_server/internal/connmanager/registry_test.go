@@ -0,0 +1,98 @@
+package connmanager
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRegistryOrderAndRemove(t *testing.T) {
+	r := newRegistry()
+	var ids []string
+	for range 5 {
+		c := &Connection{ID: newConnectionID()}
+		r.add(c)
+		ids = append(ids, c.ID)
+	}
+
+	if c, total := r.remove(ids[2]); c == nil || total != 4 {
+		t.Fatalf("remove(%s) = %v, %d; want connection, 4", ids[2], c, total)
+	}
+	if c, _ := r.remove(ids[2]); c != nil {
+		t.Fatalf("second remove(%s) returned a connection", ids[2])
+	}
+
+	want := []string{ids[0], ids[1], ids[3], ids[4]}
+	got := r.snapshot()
+	if len(got) != len(want) {
+		t.Fatalf("snapshot has %d connections, want %d", len(got), len(want))
+	}
+	for i, c := range got {
+		if c.ID != want[i] {
+			t.Errorf("snapshot[%d] = %s, want %s", i, c.ID, want[i])
+		}
+	}
+	if _, ok := r.get(ids[3]); !ok {
+		t.Errorf("get(%s) did not find the connection", ids[3])
+	}
+}
+
+func TestRegistrySnapshotIsInvalidated(t *testing.T) {
+	r := newRegistry()
+	r.add(&Connection{ID: newConnectionID()})
+	if n := len(r.snapshot()); n != 1 {
+		t.Fatalf("snapshot has %d connections, want 1", n)
+	}
+	r.add(&Connection{ID: newConnectionID()})
+	if n := len(r.snapshot()); n != 2 {
+		t.Fatalf("snapshot has %d connections after add, want 2", n)
+	}
+}
+
+// BenchmarkRegistryChurn replaces connections concurrently while the
+// registry holds size connections, with an occasional snapshot as drains and
+// status queries take them
+func BenchmarkRegistryChurn(b *testing.B) {
+	for _, size := range []int{10_000, 100_000} {
+		b.Run(fmt.Sprintf("%dk", size/1000), func(b *testing.B) {
+			r := newRegistry()
+			for range size {
+				r.add(&Connection{ID: newConnectionID()})
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					c := &Connection{ID: newConnectionID()}
+					r.add(c)
+					if i%100 == 0 {
+						_ = r.snapshot()
+					}
+					r.remove(c.ID)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkRegistryLookup(b *testing.B) {
+	for _, size := range []int{10_000, 100_000} {
+		b.Run(fmt.Sprintf("%dk", size/1000), func(b *testing.B) {
+			r := newRegistry()
+			ids := make([]string, size)
+			for i := range ids {
+				c := &Connection{ID: newConnectionID()}
+				r.add(c)
+				ids[i] = c.ID
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					r.get(ids[i%size])
+					i++
+				}
+			})
+		})
+	}
+}
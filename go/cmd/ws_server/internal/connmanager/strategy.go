@@ -0,0 +1,169 @@
+package connmanager
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Strategy selects which connections to close when draining
+type Strategy interface {
+	// Name identifies the strategy in control commands and logs
+	Name() string
+	// Select returns at most n of the given connections, in close order.
+	// It must not modify the connections slice.
+	Select(connections []*Connection, n int) []*Connection
+}
+
+// StrategyFunc adapts a function to the Strategy interface
+type StrategyFunc struct {
+	name     string
+	selectFn func(connections []*Connection, n int) []*Connection
+}
+
+func NewStrategyFunc(name string, fn func(connections []*Connection, n int) []*Connection) *StrategyFunc {
+	return &StrategyFunc{name: name, selectFn: fn}
+}
+
+func (s *StrategyFunc) Name() string {
+	return s.name
+}
+
+func (s *StrategyFunc) Select(connections []*Connection, n int) []*Connection {
+	return s.selectFn(connections, n)
+}
+
+// Built-in strategy names
+const (
+	StrategyOldest     = "oldest"
+	StrategyNewest     = "newest"
+	StrategyIdle       = "idle"
+	StrategyNoInFlight = "no-inflight"
+	StrategyRandom     = "random"
+	StrategyRoundRobin = "round-robin-ip"
+)
+
+var (
+	strategiesMu sync.RWMutex
+	strategies   = map[string]Strategy{
+		StrategyOldest:     NewStrategyFunc(StrategyOldest, selectOldest),
+		StrategyNewest:     NewStrategyFunc(StrategyNewest, selectNewest),
+		StrategyIdle:       NewStrategyFunc(StrategyIdle, selectIdle),
+		StrategyNoInFlight: NewStrategyFunc(StrategyNoInFlight, selectNoInFlight),
+		StrategyRandom:     NewStrategyFunc(StrategyRandom, selectRandom),
+		StrategyRoundRobin: NewStrategyFunc(StrategyRoundRobin, selectRoundRobinIP),
+	}
+)
+
+// RegisterStrategy makes s available to StrategyByName, replacing any
+// strategy registered under the same name
+func RegisterStrategy(s Strategy) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	strategies[s.Name()] = s
+}
+
+func StrategyByName(name string) (Strategy, error) {
+	strategiesMu.RLock()
+	defer strategiesMu.RUnlock()
+	s, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown drain strategy %q", name)
+	}
+	return s, nil
+}
+
+// StrategyNames lists the registered strategies in alphabetical order
+func StrategyNames() []string {
+	strategiesMu.RLock()
+	defer strategiesMu.RUnlock()
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedBy(connections []*Connection, n int, cmpFn func(a, b *Connection) int) []*Connection {
+	sorted := slices.Clone(connections)
+	slices.SortStableFunc(sorted, cmpFn)
+	return sorted[:min(max(n, 0), len(sorted))]
+}
+
+func selectOldest(connections []*Connection, n int) []*Connection {
+	return sortedBy(connections, n, func(a, b *Connection) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+}
+
+func selectNewest(connections []*Connection, n int) []*Connection {
+	return sortedBy(connections, n, func(a, b *Connection) int {
+		return b.ConnectedAt.Compare(a.ConnectedAt)
+	})
+}
+
+func selectIdle(connections []*Connection, n int) []*Connection {
+	return sortedBy(connections, n, func(a, b *Connection) int {
+		return a.LastActivity().Compare(b.LastActivity())
+	})
+}
+
+// selectNoInFlight prefers connections without a running operation and
+// falls back to the oldest busy ones
+func selectNoInFlight(connections []*Connection, n int) []*Connection {
+	return sortedBy(connections, n, func(a, b *Connection) int {
+		return cmp.Or(
+			cmp.Compare(a.InFlight(), b.InFlight()),
+			a.ConnectedAt.Compare(b.ConnectedAt),
+		)
+	})
+}
+
+func selectRandom(connections []*Connection, n int) []*Connection {
+	shuffled := slices.Clone(connections)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled[:min(max(n, 0), len(shuffled))]
+}
+
+// selectRoundRobinIP takes the oldest connection of each client IP in turn,
+// so a drain spreads over clients instead of emptying one of them first
+func selectRoundRobinIP(connections []*Connection, n int) []*Connection {
+	var order []string
+	groups := make(map[string][]*Connection)
+	for _, c := range selectOldest(connections, len(connections)) {
+		ip := c.ClientIP()
+		if _, ok := groups[ip]; !ok {
+			order = append(order, ip)
+		}
+		groups[ip] = append(groups[ip], c)
+	}
+
+	selected := make([]*Connection, 0, min(max(n, 0), len(connections)))
+	for len(selected) < cap(selected) {
+		for _, ip := range order {
+			if len(groups[ip]) == 0 || len(selected) == cap(selected) {
+				continue
+			}
+			selected = append(selected, groups[ip][0])
+			groups[ip] = groups[ip][1:]
+		}
+	}
+	return selected
+}
+
+// ParseStrategy resolves name to a strategy, falling back to def when name
+// is empty
+func ParseStrategy(name string, def Strategy) (Strategy, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return def, nil
+	}
+	return StrategyByName(name)
+}
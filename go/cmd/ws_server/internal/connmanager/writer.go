@@ -0,0 +1,234 @@
+package connmanager
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+	"github.com/gorilla/websocket"
+)
+
+// OverflowPolicy decides what happens to a message sent to a connection
+// whose send queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowDrop discards the message
+	OverflowDrop OverflowPolicy = "drop"
+	// OverflowClose closes the slow consumer
+	OverflowClose OverflowPolicy = "close"
+	// OverflowBlock waits up to SendOptions.BlockTimeout for room in the
+	// queue and discards the message after that
+	OverflowBlock OverflowPolicy = "block"
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case OverflowDrop, OverflowClose, OverflowBlock:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q", s)
+}
+
+// SendOptions configures the outbound queue of new connections
+type SendOptions struct {
+	QueueSize    int
+	Overflow     OverflowPolicy
+	BlockTimeout time.Duration
+	// WriteTimeout bounds a single frame write, so a peer that stopped
+	// reading cannot stall the writer forever
+	WriteTimeout time.Duration
+	// CloseTimeout is how long SendClose waits for room in the queue and
+	// for the frame to be written
+	CloseTimeout time.Duration
+}
+
+func DefaultSendOptions() SendOptions {
+	return SendOptions{
+		QueueSize:    64,
+		Overflow:     OverflowBlock,
+		BlockTimeout: 5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		CloseTimeout: 5 * time.Second,
+	}
+}
+
+// withDefaults fills the zero timeouts from DefaultSendOptions
+func (o SendOptions) withDefaults() SendOptions {
+	def := DefaultSendOptions()
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = def.WriteTimeout
+	}
+	if o.CloseTimeout <= 0 {
+		o.CloseTimeout = def.CloseTimeout
+	}
+	return o
+}
+
+var (
+	ErrConnectionClosed = errors.New("connection closed")
+	ErrQueueFull        = errors.New("send queue full")
+	ErrSlowConsumer     = errors.New("slow consumer closed")
+)
+
+type outbound struct {
+	messageType int
+	data        []byte
+	// written receives the write result when set
+	written chan error
+}
+
+// Send queues a message for the connection's writer. It returns once the
+// message is queued, not when it is written; the overflow policy applies
+// when the queue is full. Once SendClose was called it returns
+// ErrConnectionClosed.
+func (c *Connection) Send(messageType int, data []byte) error {
+	return c.enqueue(outbound{messageType: messageType, data: data}, c.send.Overflow)
+}
+
+// TrySend queues a message like Send but never waits or closes the
+// connection: a full queue drops the message and returns ErrQueueFull,
+// whatever the overflow policy
+func (c *Connection) TrySend(messageType int, data []byte) error {
+	return c.enqueue(outbound{messageType: messageType, data: data}, OverflowDrop)
+}
+
+func (c *Connection) enqueue(msg outbound, overflow OverflowPolicy) error {
+	c.sendMu.RLock()
+	defer c.sendMu.RUnlock()
+	select {
+	case <-c.closing:
+		return ErrConnectionClosed
+	default:
+	}
+
+	select {
+	case <-c.writerDone:
+		return ErrConnectionClosed
+	case c.queue <- msg:
+		return nil
+	default:
+	}
+
+	metrics.SendQueueOverflows.Inc(string(overflow))
+	switch overflow {
+	case OverflowClose:
+		slog.Warn("Send queue full, closing slow consumer", "id", c.ID, "queued", len(c.queue))
+		c.MarkClosed(websocket.ClosePolicyViolation, "slow consumer", InitiatorServer)
+		c.Close()
+		return ErrSlowConsumer
+	case OverflowBlock:
+		timer := time.NewTimer(c.send.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case <-c.writerDone:
+			return ErrConnectionClosed
+		case <-c.closing:
+			return ErrConnectionClosed
+		case c.queue <- msg:
+			return nil
+		case <-timer.C:
+		}
+	}
+	slog.Warn("Send queue full, message dropped", "id", c.ID, "policy", overflow)
+	return ErrQueueFull
+}
+
+// SendClose queues a close frame behind the messages already queued and
+// waits until it is written. Nothing is written after a close frame: later
+// Send and SendClose calls return ErrConnectionClosed.
+func (c *Connection) SendClose(code int, reason string) error {
+	msg := outbound{
+		messageType: websocket.CloseMessage,
+		data:        websocket.FormatCloseMessage(code, reason),
+		written:     make(chan error, 1),
+	}
+
+	// Wake Sends blocked on a full queue, then wait for the ones still
+	// queueing before taking the last place in the queue
+	c.closingOnce.Do(func() { close(c.closing) })
+	c.sendMu.Lock()
+	queued := c.closeQueued
+	c.closeQueued = true
+	c.sendMu.Unlock()
+	if queued {
+		return ErrConnectionClosed
+	}
+
+	timer := time.NewTimer(c.send.CloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.writerDone:
+		return ErrConnectionClosed
+	case c.queue <- msg:
+	case <-timer.C:
+		return ErrQueueFull
+	}
+
+	select {
+	case err := <-msg.written:
+		return err
+	case <-c.writerDone:
+		return ErrConnectionClosed
+	case <-timer.C:
+		return errors.New("timed out writing close frame")
+	}
+}
+
+// Close stops the writer and closes the network connection without a close
+// handshake. It is safe to call more than once.
+func (c *Connection) Close() error {
+	var err error
+	c.stopOnce.Do(func() {
+		close(c.stopWriter)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// QueueLen returns the number of messages waiting to be written
+func (c *Connection) QueueLen() int {
+	return len(c.queue)
+}
+
+// writeLoop is the only goroutine writing to the WebSocket connection. It
+// also sends the keepalive pings.
+func (c *Connection) writeLoop() {
+	defer close(c.writerDone)
+
+	var tick <-chan time.Time
+	if interval := c.keepalive.tickInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.stopWriter:
+			return
+		case now := <-tick:
+			if c.keepaliveTick(now) {
+				return
+			}
+		case msg := <-c.queue:
+			_ = c.Conn.SetWriteDeadline(time.Now().Add(c.send.WriteTimeout))
+			err := c.Conn.WriteMessage(msg.messageType, msg.data)
+			if msg.written != nil {
+				msg.written <- err
+			}
+			if err != nil {
+				slog.Error("Failed to write WebSocket message", "id", c.ID, "error", err)
+				// Unblock the reader so the handler cleans up
+				c.Close()
+				return
+			}
+			if msg.messageType == websocket.CloseMessage {
+				return
+			}
+			c.recordOutbound(len(msg.data))
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package connmanager
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSendAfterClose(t *testing.T) {
+	// No writer runs, so the single queue slot stays taken
+	c := &Connection{
+		queue:      make(chan outbound, 1),
+		writerDone: make(chan struct{}),
+		closing:    make(chan struct{}),
+		send: SendOptions{
+			Overflow:     OverflowBlock,
+			BlockTimeout: time.Minute,
+			CloseTimeout: 10 * time.Millisecond,
+		},
+	}
+	if err := c.Send(websocket.TextMessage, []byte("queued")); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := make(chan error)
+	go func() { blocked <- c.Send(websocket.TextMessage, []byte("blocked")) }()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := c.SendClose(websocket.CloseGoingAway, "bye"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("SendClose on a full queue: %v, want ErrQueueFull", err)
+	}
+	select {
+	case err := <-blocked:
+		if !errors.Is(err, ErrConnectionClosed) {
+			t.Errorf("blocked Send: %v, want ErrConnectionClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked Send not woken by SendClose")
+	}
+
+	if err := c.Send(websocket.TextMessage, []byte("late")); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("Send after SendClose: %v, want ErrConnectionClosed", err)
+	}
+	if err := c.SendClose(websocket.CloseGoingAway, "again"); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("second SendClose: %v, want ErrConnectionClosed", err)
+	}
+	if n := c.QueueLen(); n != 1 {
+		t.Errorf("%d messages queued, want only the first", n)
+	}
+}
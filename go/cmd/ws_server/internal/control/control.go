@@ -0,0 +1,57 @@
+// Package control executes the server's control commands. The TCP service
+// port and the HTTP admin API both go through Run, so the two expose the
+// same commands with the same arguments, results and errors.
+package control
+
+import (
+	"io"
+	"log/slog"
+	"slices"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+	"github.com/ArditZubaku/go-node-ws/internal/shutdown"
+)
+
+// Role is what an authenticated control client may do
+type Role string
+
+const (
+	// RoleReadOnly may only run commands that do not change server state
+	RoleReadOnly Role = "read"
+	// RoleAdmin may run every command, including destructive ones
+	RoleAdmin Role = "admin"
+)
+
+// readOnlyCommands lists the commands RoleReadOnly is authorized to run
+var readOnlyCommands = []string{"status", "list", "get", "phase"}
+
+// Allows reports whether the role is authorized to run cmd
+func (r Role) Allows(cmd string) bool {
+	return r == RoleAdmin || slices.Contains(readOnlyCommands, cmd)
+}
+
+// Run authorizes and executes req on behalf of a client with the given
+// role. Events of a watched request are written to w as they happen.
+func Run(req Request, w io.Writer, role Role, cm *connmanager.ConnectionManager, engine *drain.Engine, orch *shutdown.Orchestrator) Response {
+	var resp Response
+	if !role.Allows(req.Command) {
+		resp = Response{
+			Version: ProtocolVersion,
+			ID:      req.ID,
+			Error:   NewError(CodeForbidden, "role %q may not run %q", role, req.Command),
+		}
+	} else {
+		slog.Info("Received control request", "id", req.ID, "command", req.Command)
+		resp = execute(req, w, cm, engine, orch)
+		// Only count commands the server knows, the label set stays bounded
+		if resp.Error == nil || (resp.Error.Code != CodeUnknownCommand && resp.Error.Code != CodeUnsupportedVersion) {
+			metrics.ControlCommands.Inc(req.Command)
+		}
+	}
+	if resp.Error != nil {
+		slog.Error("Control request failed", "id", resp.ID, "code", resp.Error.Code, "error", resp.Error.Message)
+	}
+	return resp
+}
@@ -0,0 +1,419 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+	"github.com/ArditZubaku/go-node-ws/internal/shutdown"
+)
+
+// ProtocolVersion is the version of the JSON-lines control protocol
+const ProtocolVersion = 1
+
+// Request is a single JSON-lines control command, e.g.
+//
+//	{"v":1,"id":"42","cmd":"close","args":{"count":10,"strategy":"idle"}}
+//
+// With Watch set, close, kick and drain stream an event line per closed
+// connection and phase change before the final response, whose result is
+// a summary of the closes.
+type Request struct {
+	Version int             `json:"v"`
+	ID      string          `json:"id"`
+	Command string          `json:"cmd"`
+	Args    json.RawMessage `json:"args,omitempty"`
+	Watch   bool            `json:"watch,omitempty"`
+
+	// commandID tags the closes of a watched request and tally counts
+	// them, see Watch
+	commandID string
+	tally     *connmanager.CloseTally
+}
+
+// Response answers a Request and echoes its ID
+type Response struct {
+	Version int    `json:"v"`
+	ID      string `json:"id"`
+	OK      bool   `json:"ok"`
+	Result  any    `json:"result,omitempty"`
+	Error   *Error `json:"error,omitempty"`
+}
+
+// EventLine is a line streamed by a watched Request before its Response
+type EventLine struct {
+	Version int               `json:"v"`
+	ID      string            `json:"id"`
+	Event   connmanager.Event `json:"event"`
+}
+
+// ErrorCode classifies why a command failed
+type ErrorCode string
+
+const (
+	CodeBadRequest         ErrorCode = "bad_request"
+	CodeUnsupportedVersion ErrorCode = "unsupported_version"
+	CodeUnknownCommand     ErrorCode = "unknown_command"
+	CodeInvalidArgument    ErrorCode = "invalid_argument"
+	CodeUnauthorized       ErrorCode = "unauthorized"
+	CodeForbidden          ErrorCode = "forbidden"
+	CodeNotFound           ErrorCode = "not_found"
+	CodeConflict           ErrorCode = "conflict"
+	CodeInternal           ErrorCode = "internal"
+)
+
+// Error is a typed command failure reported back to the client
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+func NewError(code ErrorCode, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// toError maps errors from the packages commands call into typed errors
+func toError(err error) *Error {
+	var typed *Error
+	switch {
+	case errors.As(err, &typed):
+		return typed
+	case errors.Is(err, drain.ErrAlreadyRunning),
+		errors.Is(err, drain.ErrNotRunning),
+		errors.Is(err, drain.ErrNotPaused),
+		errors.Is(err, shutdown.ErrUpgradeUnsupported),
+		errors.Is(err, shutdown.ErrUpgradeInProgress),
+		errors.Is(err, shutdown.ErrShuttingDown):
+		return NewError(CodeConflict, "%s", err)
+	case errors.Is(err, drain.ErrInvalidPlan):
+		return NewError(CodeInvalidArgument, "%s", err)
+	default:
+		return NewError(CodeInternal, "%s", err)
+	}
+}
+
+// Duration is a time.Duration that is encoded as a Go duration string
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// inFlightArgs select how connections with running operations are closed
+// and where their clients are advised to reconnect
+type inFlightArgs struct {
+	InFlight          string   `json:"in_flight,omitempty"`
+	WaitTimeout       Duration `json:"wait_timeout,omitempty"`
+	ReconnectEndpoint string   `json:"reconnect_endpoint,omitempty"`
+}
+
+func (a inFlightArgs) options() (connmanager.CloseOptions, error) {
+	opts := connmanager.CloseOptions{
+		Timeout:   time.Duration(a.WaitTimeout),
+		Reconnect: connmanager.ReconnectAdvice{Endpoint: a.ReconnectEndpoint},
+	}
+	if a.InFlight != "" {
+		policy, err := connmanager.ParseInFlightPolicy(a.InFlight)
+		if err != nil {
+			return opts, NewError(CodeInvalidArgument, "%s", err)
+		}
+		opts.Policy = policy
+	}
+	return opts, nil
+}
+
+type closeArgs struct {
+	Count    int    `json:"count"`
+	Strategy string `json:"strategy,omitempty"`
+	inFlightArgs
+}
+
+type drainArgs struct {
+	Mode     drain.Mode `json:"mode"`
+	Percent  float64    `json:"percent,omitempty"`
+	Count    int        `json:"count,omitempty"`
+	Interval Duration   `json:"interval,omitempty"`
+	Duration Duration   `json:"duration,omitempty"`
+	Strategy string     `json:"strategy,omitempty"`
+	inFlightArgs
+}
+
+// listArgs page through the connections the filter matches
+type listArgs struct {
+	Offset int `json:"offset,omitempty"`
+	Limit  int `json:"limit,omitempty"`
+	connmanager.Filter
+}
+
+type getArgs struct {
+	ID string `json:"id"`
+}
+
+type kickArgs struct {
+	ID string `json:"id"`
+	inFlightArgs
+}
+
+// StatusResult is the result of the status command
+type StatusResult struct {
+	Connections     int                      `json:"connections"`
+	InFlight        int                      `json:"in_flight"`
+	Reaped          connmanager.ReapedCounts `json:"reaped"`
+	DefaultStrategy string                   `json:"default_strategy"`
+	Strategies      []string                 `json:"strategies"`
+	Drain           drain.Status             `json:"drain"`
+	Shutdown        shutdown.Status          `json:"shutdown"`
+}
+
+type listResult struct {
+	Total       int                          `json:"total"`
+	Connections []connmanager.ConnectionInfo `json:"connections"`
+}
+
+// upgradeResult names the process that took over the listeners
+type upgradeResult struct {
+	ChildPID int `json:"child_pid"`
+}
+
+// plan returns the plan the args describe. Args that are not given stay
+// zero, so a retune keeps the running plan's values for them.
+func (a drainArgs) plan() (drain.Plan, error) {
+	strategy, err := connmanager.ParseStrategy(a.Strategy, nil)
+	if err != nil {
+		return drain.Plan{}, NewError(CodeInvalidArgument, "%s", err)
+	}
+	opts, err := a.options()
+	if err != nil {
+		return drain.Plan{}, err
+	}
+	return drain.Plan{
+		Mode:     a.Mode,
+		Percent:  a.Percent,
+		Count:    a.Count,
+		Interval: time.Duration(a.Interval),
+		Duration: time.Duration(a.Duration),
+		Strategy: strategy,
+		Close:    opts,
+	}, nil
+}
+
+// execute runs a JSON-lines request and builds its response. Events of a
+// watched request are written to w as they happen.
+func execute(req Request, w io.Writer, cm *connmanager.ConnectionManager, engine *drain.Engine, orch *shutdown.Orchestrator) Response {
+	resp := Response{Version: ProtocolVersion, ID: req.ID}
+	var result any
+	var err error
+	if req.Watch {
+		result, err = executeWatch(req, w, cm, engine, orch)
+	} else {
+		result, err = dispatch(req, cm, engine, orch)
+	}
+	if err != nil {
+		resp.Error = toError(err)
+		return resp
+	}
+	resp.OK = true
+	resp.Result = result
+	return resp
+}
+
+func executeWatch(req Request, w io.Writer, cm *connmanager.ConnectionManager, engine *drain.Engine, orch *shutdown.Orchestrator) (any, error) {
+	waitDrain, ok := watchWaitsForDrain(req.Command)
+	if !ok {
+		return nil, NewError(CodeInvalidArgument, "%q cannot be watched", req.Command)
+	}
+	return Watch(cm, engine, waitDrain,
+		func(commandID string, tally *connmanager.CloseTally) (any, error) {
+			req.commandID, req.tally = commandID, tally
+			return dispatch(req, cm, engine, orch)
+		},
+		func(e connmanager.Event) error {
+			return WriteJSONLine(w, EventLine{Version: ProtocolVersion, ID: req.ID, Event: e})
+		},
+	)
+}
+
+func dispatch(req Request, cm *connmanager.ConnectionManager, engine *drain.Engine, orch *shutdown.Orchestrator) (any, error) {
+	if req.Version != ProtocolVersion {
+		return nil, NewError(CodeUnsupportedVersion, "protocol version %d is not supported, use %d", req.Version, ProtocolVersion)
+	}
+
+	switch req.Command {
+	case "close":
+		var args closeArgs
+		if err := decodeArgs(req.Args, &args); err != nil {
+			return nil, err
+		}
+		strategy, err := connmanager.ParseStrategy(args.Strategy, cm.DefaultStrategy())
+		if err != nil {
+			return nil, NewError(CodeInvalidArgument, "%s", err)
+		}
+		if args.Count <= 0 {
+			return nil, NewError(CodeInvalidArgument, "count must be positive")
+		}
+		opts, err := args.options()
+		if err != nil {
+			return nil, err
+		}
+		opts.CommandID, opts.Tally = req.commandID, req.tally
+		return map[string]int{"closed": cm.CloseNConnections(args.Count, strategy, opts)}, nil
+
+	case "drain", "retune":
+		var args drainArgs
+		if err := decodeArgs(req.Args, &args); err != nil {
+			return nil, err
+		}
+		plan, err := args.plan()
+		if err != nil {
+			return nil, err
+		}
+		plan.Close.CommandID, plan.Close.Tally = req.commandID, req.tally
+		if req.Command == "drain" {
+			err = engine.Start(plan)
+		} else {
+			err = engine.Update(plan)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return engine.Status(), nil
+
+	case "pause", "resume", "cancel":
+		var err error
+		switch req.Command {
+		case "pause":
+			err = engine.Pause()
+		case "resume":
+			err = engine.Resume()
+		default:
+			err = engine.Cancel()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return engine.Status(), nil
+
+	case "status":
+		return StatusResult{
+			Connections:     cm.GetConnectionsCount(),
+			InFlight:        cm.InFlightCount(),
+			Reaped:          cm.Reaped(),
+			DefaultStrategy: cm.DefaultStrategy().Name(),
+			Strategies:      connmanager.StrategyNames(),
+			Drain:           engine.Status(),
+			Shutdown:        orch.Status(),
+		}, nil
+
+	case "list":
+		var args listArgs
+		if err := decodeArgs(req.Args, &args); err != nil {
+			return nil, err
+		}
+		if args.Offset < 0 || args.Limit < 0 {
+			return nil, NewError(CodeInvalidArgument, "offset and limit must not be negative")
+		}
+		connections := cm.Connections()
+		if args.Filter != (connmanager.Filter{}) {
+			connections = slices.DeleteFunc(slices.Clone(connections), func(c *connmanager.Connection) bool {
+				return !args.Match(c)
+			})
+		}
+		page := connections[min(args.Offset, len(connections)):]
+		if args.Limit > 0 {
+			page = page[:min(args.Limit, len(page))]
+		}
+		result := listResult{
+			Total:       len(connections),
+			Connections: make([]connmanager.ConnectionInfo, 0, len(page)),
+		}
+		for _, c := range page {
+			result.Connections = append(result.Connections, c.Info())
+		}
+		return result, nil
+
+	case "get":
+		var args getArgs
+		if err := decodeArgs(req.Args, &args); err != nil {
+			return nil, err
+		}
+		c, ok := cm.GetConnection(args.ID)
+		if !ok {
+			return nil, NewError(CodeNotFound, "connection %q not found", args.ID)
+		}
+		return c.Info(), nil
+
+	case "phase":
+		return orch.Status(), nil
+
+	case "upgrade":
+		pid, err := orch.Upgrade()
+		if err != nil {
+			return nil, err
+		}
+		return upgradeResult{ChildPID: pid}, nil
+
+	case "kick":
+		var args kickArgs
+		if err := decodeArgs(req.Args, &args); err != nil {
+			return nil, err
+		}
+		opts, err := args.options()
+		if err != nil {
+			return nil, err
+		}
+		opts.CommandID, opts.Tally = req.commandID, req.tally
+		if !cm.CloseConnection(args.ID, opts) {
+			return nil, NewError(CodeNotFound, "connection %q not found", args.ID)
+		}
+		return map[string]string{"kicked": args.ID}, nil
+
+	case "broadcast", "send":
+		var args connmanager.BroadcastRequest
+		if err := decodeArgs(req.Args, &args); err != nil {
+			return nil, err
+		}
+		if req.Command == "send" && args.ID == "" {
+			return nil, NewError(CodeInvalidArgument, "id is required")
+		}
+		msg, err := args.Payload()
+		if err != nil {
+			return nil, NewError(CodeInvalidArgument, "%s", err)
+		}
+		report := cm.SendTo(args.Filter, msg)
+		if req.Command == "send" && len(report.Recipients) == 0 {
+			return nil, NewError(CodeNotFound, "connection %q not found", args.ID)
+		}
+		return report, nil
+
+	default:
+		return nil, NewError(CodeUnknownCommand, "unknown command %q", req.Command)
+	}
+}
+
+func decodeArgs(raw json.RawMessage, v any) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return NewError(CodeInvalidArgument, "invalid args: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package control
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+)
+
+// watchBuffer sizes the event subscription of a watch, large enough for a
+// close of every connection on a busy server between two writes
+const watchBuffer = 4096
+
+// watchedEvents are streamed to a watching control client
+var watchedEvents = []connmanager.EventType{
+	connmanager.EventCloseResult,
+	connmanager.EventDrainStarted,
+	connmanager.EventDrainFinished,
+	connmanager.EventShutdownPhase,
+}
+
+// WatchSummary is the last line of a watch
+type WatchSummary struct {
+	Type    string `json:"type"`
+	Clean   int    `json:"clean"`
+	Failed  int    `json:"failed"`
+	Gone    int    `json:"gone"`
+	Dropped uint64 `json:"dropped,omitempty"`
+	Elapsed string `json:"elapsed"`
+	// Result is what the command returned without watch
+	Result any `json:"result,omitempty"`
+}
+
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// watchWaitsForDrain reports whether watching cmd lasts until the drain it
+// started finishes, and whether cmd can be watched at all
+func watchWaitsForDrain(cmd string) (wait, ok bool) {
+	switch cmd {
+	case "close", "kick":
+		return false, true
+	case "drain":
+		return true, true
+	}
+	return false, false
+}
+
+// newCommandID returns the ID a watched command tags its events with
+func newCommandID() string {
+	b := make([]byte, 8)
+	// crypto/rand.Read never returns an error
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Watch runs a command and passes its close results and drain events, and
+// every shutdown phase change, to emit until the command, or the drain it
+// started, is done. run must set the command ID and the tally it is given
+// on the CloseOptions of the command, closes made by other commands
+// meanwhile are neither emitted nor counted. The totals of the summary come
+// from the tally, so they stay exact when the subscription drops events.
+func Watch(
+	cm *connmanager.ConnectionManager,
+	engine *drain.Engine,
+	waitDrain bool,
+	run func(commandID string, tally *connmanager.CloseTally) (any, error),
+	emit func(connmanager.Event) error,
+) (WatchSummary, error) {
+	sub := cm.Subscribe(watchBuffer, watchedEvents...)
+	defer sub.Close()
+
+	start := time.Now()
+	summary := WatchSummary{Type: "summary"}
+
+	type outcome struct {
+		result any
+		err    error
+	}
+	id := newCommandID()
+	var tally connmanager.CloseTally
+	finished := make(chan outcome, 1)
+	go func() {
+		result, err := run(id, &tally)
+		finished <- outcome{result, err}
+	}()
+
+	handle := func(e connmanager.Event) error {
+		if e.Type != connmanager.EventShutdownPhase && e.CommandID != id {
+			return nil
+		}
+		return emit(e)
+	}
+
+	var done <-chan struct{}
+	for {
+		select {
+		case e := <-sub.C:
+			if err := handle(e); err != nil {
+				return summary, err
+			}
+		case o := <-finished:
+			if o.err != nil {
+				return summary, o.err
+			}
+			summary.Result = o.result
+			finished = nil
+			done = closedChan
+			if waitDrain {
+				done = engine.Done()
+			}
+		case <-done:
+			// Flush what was published before the command finished
+		flush:
+			for {
+				select {
+				case e := <-sub.C:
+					if err := handle(e); err != nil {
+						return summary, err
+					}
+				default:
+					break flush
+				}
+			}
+			summary.Clean, summary.Failed, summary.Gone = tally.Counts()
+			summary.Dropped = sub.Dropped()
+			summary.Elapsed = time.Since(start).Round(time.Millisecond).String()
+			return summary, nil
+		}
+	}
+}
+
+// WriteJSONLine writes v to w as a single line of JSON
+func WriteJSONLine(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
@@ -0,0 +1,61 @@
+package control
+
+import (
+	"testing"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+)
+
+func TestWatchOnlyCountsItsCommand(t *testing.T) {
+	cm := connmanager.NewConnectionManager()
+	var emitted []connmanager.Event
+	summary, err := Watch(cm, drain.NewEngine(cm), false,
+		func(commandID string, tally *connmanager.CloseTally) (any, error) {
+			tally.Add(connmanager.CloseClean)
+			cm.Publish(connmanager.Event{Type: connmanager.EventCloseResult, CommandID: commandID, Outcome: connmanager.CloseClean})
+			cm.Publish(connmanager.Event{Type: connmanager.EventCloseResult, CommandID: "other", Outcome: connmanager.CloseFailed})
+			cm.Publish(connmanager.Event{Type: connmanager.EventCloseResult, Outcome: connmanager.CloseGone})
+			cm.Publish(connmanager.Event{Type: connmanager.EventDrainStarted, CommandID: "other"})
+			cm.Publish(connmanager.Event{Type: connmanager.EventShutdownPhase, Phase: "drain"})
+			return "done", nil
+		},
+		func(e connmanager.Event) error {
+			emitted = append(emitted, e)
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Clean != 1 || summary.Failed != 0 || summary.Gone != 0 || summary.Result != "done" {
+		t.Errorf("summary %+v, want only the watched clean close", summary)
+	}
+	if len(emitted) != 2 || emitted[0].Outcome != connmanager.CloseClean || emitted[1].Type != connmanager.EventShutdownPhase {
+		t.Errorf("emitted %+v, want the watched close and the phase change", emitted)
+	}
+}
+
+func TestWatchCountsClosesWithoutEvents(t *testing.T) {
+	cm := connmanager.NewConnectionManager()
+	summary, err := Watch(cm, drain.NewEngine(cm), false,
+		func(commandID string, tally *connmanager.CloseTally) (any, error) {
+			// The bus dropped the close results, the tally still counts them
+			tally.Add(connmanager.CloseClean)
+			tally.Add(connmanager.CloseFailed)
+			tally.Add(connmanager.CloseGone)
+			tally.Add(connmanager.CloseGone)
+			return nil, nil
+		},
+		func(e connmanager.Event) error {
+			t.Errorf("emitted %+v, no event was published", e)
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Clean != 1 || summary.Failed != 1 || summary.Gone != 2 {
+		t.Errorf("summary %+v, want 1 clean, 1 failed and 2 gone", summary)
+	}
+}
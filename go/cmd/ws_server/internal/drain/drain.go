@@ -0,0 +1,321 @@
+// Package drain runs rate-paced progressive drains of WebSocket connections,
+// so clients are moved off the server gradually instead of all at once.
+package drain
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+)
+
+// State is the lifecycle state of a drain
+type State string
+
+const (
+	StateIdle      State = "idle"
+	StateRunning   State = "running"
+	StatePaused    State = "paused"
+	StateCompleted State = "completed"
+	StateCancelled State = "cancelled"
+)
+
+var (
+	ErrAlreadyRunning = errors.New("a drain is already in progress")
+	ErrNotRunning     = errors.New("no drain in progress")
+	ErrNotPaused      = errors.New("drain is not paused")
+)
+
+// Status reports the progress of the current or last drain
+type Status struct {
+	State     State     `json:"state"`
+	Plan      string    `json:"plan,omitempty"`
+	Strategy  string    `json:"strategy,omitempty"`
+	Closed    int       `json:"closed"`
+	Remaining int       `json:"remaining"`
+	StartedAt time.Time `json:"started_at,omitzero"`
+	Elapsed   string    `json:"elapsed,omitempty"`
+}
+
+// Engine executes one drain plan at a time against a ConnectionManager
+type Engine struct {
+	cm *connmanager.ConnectionManager
+
+	mu        sync.Mutex
+	state     State
+	plan      Plan
+	closed    int
+	startedAt time.Time
+	endedAt   time.Time
+	deadline  time.Time
+	pausedAt  time.Time
+	control   chan Plan
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func NewEngine(cm *connmanager.ConnectionManager) *Engine {
+	return &Engine{cm: cm, state: StateIdle}
+}
+
+// Start begins executing plan in the background
+func (e *Engine) Start(plan Plan) error {
+	plan = plan.withDefaults(e.cm.DefaultStrategy())
+	if err := plan.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPlan, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.active() {
+		return ErrAlreadyRunning
+	}
+
+	plan.base = e.cm.GetConnectionsCount()
+	e.state = StateRunning
+	e.plan = plan
+	e.closed = 0
+	e.startedAt = time.Now()
+	e.endedAt = time.Time{}
+	e.deadline = e.startedAt.Add(plan.Duration)
+	e.control = make(chan Plan, 1)
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+
+	e.cm.SetDraining(true)
+	metrics.DrainActive.Set(1)
+	metrics.DrainClosed.Set(0)
+	slog.Info("Drain started", "plan", plan.String(), "strategy", plan.Strategy.Name())
+	e.cm.Publish(connmanager.Event{
+		Type:      connmanager.EventDrainStarted,
+		CommandID: plan.Close.CommandID,
+		Plan:      plan.String(),
+		State:     string(StateRunning),
+		Remaining: e.cm.GetConnectionsCount(),
+	})
+	go e.run(plan, e.control, e.stop, e.done)
+	return nil
+}
+
+func (e *Engine) Pause() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state != StateRunning {
+		return ErrNotRunning
+	}
+	e.state = StatePaused
+	e.pausedAt = time.Now()
+	slog.Info("Drain paused", "closed", e.closed)
+	return nil
+}
+
+func (e *Engine) Resume() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state != StatePaused {
+		return ErrNotPaused
+	}
+	// Time spent paused does not count against a spread deadline
+	e.deadline = e.deadline.Add(time.Since(e.pausedAt))
+	e.state = StateRunning
+	slog.Info("Drain resumed", "closed", e.closed)
+	return nil
+}
+
+// Update retunes the running drain with the fields update sets, the others
+// keep their running values. Progress made so far is kept. A new duration
+// runs from now, otherwise the spread deadline stays where it was.
+func (e *Engine) Update(update Plan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.active() {
+		return ErrNotRunning
+	}
+	plan := e.plan.merge(update)
+	if err := plan.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPlan, err)
+	}
+	if update.Mode != "" || update.Percent != 0 {
+		plan.base = e.cm.GetConnectionsCount()
+	}
+	e.plan = plan
+	if update.Duration != 0 {
+		now := time.Now()
+		e.deadline = now.Add(plan.Duration)
+		// Only the time paused from now on extends the new deadline
+		if e.state == StatePaused {
+			e.pausedAt = now
+		}
+	}
+	// Replace any update the run loop has not picked up yet
+	select {
+	case <-e.control:
+	default:
+	}
+	e.control <- plan
+	slog.Info("Drain updated", "plan", plan.String(), "strategy", plan.Strategy.Name())
+	return nil
+}
+
+// Cancel stops the running drain and puts the server back into rotation. A
+// completed drain keeps the server out of rotation until it is cancelled, so
+// the load balancer does not send clients back to a server the operator just
+// emptied.
+func (e *Engine) Cancel() error {
+	e.mu.Lock()
+	if e.state == StateCompleted {
+		e.cm.SetDraining(false)
+		e.mu.Unlock()
+		slog.Info("Drained server back in rotation")
+		return nil
+	}
+	if !e.active() {
+		e.mu.Unlock()
+		return ErrNotRunning
+	}
+	close(e.stop)
+	done := e.done
+	e.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+// Done returns a channel closed when the current drain ends, or nil when no
+// drain was ever started
+func (e *Engine) Done() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.done
+}
+
+// Active reports whether a drain is running or paused
+func (e *Engine) Active() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.active()
+}
+
+func (e *Engine) Status() Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	status := Status{
+		State:     e.state,
+		Closed:    e.closed,
+		Remaining: e.cm.GetConnectionsCount(),
+	}
+	if e.state == StateIdle {
+		return status
+	}
+	status.Plan = e.plan.String()
+	status.Strategy = e.plan.Strategy.Name()
+	status.StartedAt = e.startedAt
+	end := e.endedAt
+	if end.IsZero() {
+		end = time.Now()
+	}
+	status.Elapsed = end.Sub(e.startedAt).Round(time.Millisecond).String()
+	return status
+}
+
+func (e *Engine) active() bool {
+	return e.state == StateRunning || e.state == StatePaused
+}
+
+func (e *Engine) run(plan Plan, control <-chan Plan, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(plan.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			e.finish(StateCancelled)
+			return
+		case plan = <-control:
+			ticker.Reset(plan.Interval)
+		case <-ticker.C:
+			if e.step() {
+				e.finish(StateCompleted)
+				return
+			}
+		}
+	}
+}
+
+// step closes one batch and reports whether the drain is complete
+func (e *Engine) step() bool {
+	e.mu.Lock()
+	if e.state != StateRunning {
+		e.mu.Unlock()
+		return false
+	}
+	plan := e.plan
+	left := time.Until(e.deadline)
+	e.mu.Unlock()
+
+	remaining := e.cm.GetConnectionsCount()
+	if remaining == 0 {
+		return true
+	}
+
+	// Spread the advised reconnect delays of this batch until the next one,
+	// so the other replicas see a steady trickle instead of bursts
+	opts := plan.Close
+	if opts.Reconnect.Spread == 0 {
+		opts.Reconnect.Spread = plan.Interval
+	}
+
+	// Connections are closed without holding the engine lock, so status
+	// queries and pause requests are not blocked by network I/O
+	closed := e.cm.CloseNConnections(plan.batchSize(remaining, left), plan.Strategy, opts)
+
+	e.mu.Lock()
+	e.closed += closed
+	total := e.closed
+	e.mu.Unlock()
+	metrics.DrainClosed.Set(float64(total))
+
+	remaining = e.cm.GetConnectionsCount()
+	slog.Info("Drain progress", "closed", total, "remaining", remaining)
+	e.cm.Publish(connmanager.Event{
+		Type:      connmanager.EventDrainProgress,
+		CommandID: plan.Close.CommandID,
+		Plan:      plan.String(),
+		State:     string(StateRunning),
+		Closed:    total,
+		Remaining: remaining,
+	})
+	return remaining == 0
+}
+
+func (e *Engine) finish(state State) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.state = state
+	e.endedAt = time.Now()
+	if state == StateCancelled {
+		e.cm.SetDraining(false)
+	}
+	metrics.DrainActive.Set(0)
+	slog.Info(
+		"Drain finished",
+		"state", state,
+		"closed", e.closed,
+		"elapsed", e.endedAt.Sub(e.startedAt).Round(time.Millisecond),
+	)
+	e.cm.Publish(connmanager.Event{
+		Type:      connmanager.EventDrainFinished,
+		CommandID: e.plan.Close.CommandID,
+		Plan:      e.plan.String(),
+		State:     string(state),
+		Closed:    e.closed,
+		Remaining: e.cm.GetConnectionsCount(),
+	})
+}
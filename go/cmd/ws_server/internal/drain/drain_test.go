@@ -0,0 +1,218 @@
+package drain
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+)
+
+func parse(t *testing.T, args string) Plan {
+	t.Helper()
+	plan, err := ParsePlan(strings.Fields(args))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func TestParsePlanLeavesUnsetFieldsZero(t *testing.T) {
+	plan := parse(t, "rate=5")
+	if plan.Mode != ModeRate || plan.Count != 5 {
+		t.Errorf("plan %+v, want rate 5", plan)
+	}
+	if plan.Interval != 0 || plan.Strategy != nil || plan.Close != (connmanager.CloseOptions{}) {
+		t.Errorf("plan %+v sets fields that were not given", plan)
+	}
+	for _, args := range []string{"rate", "rate=x", "interval=soon", "strategy=nope", "inflight=maybe", "colour=red"} {
+		if _, err := ParsePlan(strings.Fields(args)); err == nil {
+			t.Errorf("ParsePlan(%q) did not fail", args)
+		}
+	}
+}
+
+func TestStartDefaults(t *testing.T) {
+	e := NewEngine(connmanager.NewConnectionManager())
+	if err := e.Start(parse(t, "")); !errors.Is(err, ErrInvalidPlan) {
+		t.Fatalf("Start without a mode: %v, want ErrInvalidPlan", err)
+	}
+	if err := e.Start(parse(t, "rate=5")); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Cancel()
+	status := e.Status()
+	if status.Plan != "close 5 every 1s" || status.Strategy != connmanager.StrategyOldest {
+		t.Errorf("status %+v, want the default interval and strategy", status)
+	}
+}
+
+func TestRetuneKeepsRunningValues(t *testing.T) {
+	e := NewEngine(connmanager.NewConnectionManager())
+	if err := e.Start(parse(t, "rate=10 interval=1h strategy=idle inflight=wait wait=20s endpoint=wss://other")); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Cancel()
+
+	if err := e.Update(parse(t, "rate=5")); err != nil {
+		t.Fatal(err)
+	}
+	e.mu.Lock()
+	plan := e.plan
+	e.mu.Unlock()
+	if plan.Count != 5 || plan.Interval != time.Hour || plan.Strategy.Name() != connmanager.StrategyIdle {
+		t.Errorf("plan %s with %s, want 5 every 1h with idle", plan, plan.Strategy.Name())
+	}
+	want := connmanager.CloseOptions{
+		Policy:    connmanager.PolicyWait,
+		Timeout:   20 * time.Second,
+		Reconnect: connmanager.ReconnectAdvice{Endpoint: "wss://other"},
+	}
+	if plan.Close != want {
+		t.Errorf("close options %+v, want %+v", plan.Close, want)
+	}
+
+	// A count without a mode tunes the running mode, a new mode replaces it
+	if err := e.Update(Plan{Count: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Status().Plan; got != "close 7 every 1h0m0s" {
+		t.Errorf("plan %q after a count update", got)
+	}
+	if err := e.Update(parse(t, "spread=10m strategy=newest")); err != nil {
+		t.Fatal(err)
+	}
+	if status := e.Status(); status.Plan != "close all over 10m0s in steps of 1h0m0s" || status.Strategy != connmanager.StrategyNewest {
+		t.Errorf("status %+v after switching to spread", status)
+	}
+
+	if err := e.Update(parse(t, "percent=150")); !errors.Is(err, ErrInvalidPlan) {
+		t.Errorf("invalid retune: %v, want ErrInvalidPlan", err)
+	}
+	if got := e.Status().Plan; got != "close all over 10m0s in steps of 1h0m0s" {
+		t.Errorf("invalid retune changed the plan to %q", got)
+	}
+}
+
+func TestRetuneWhilePaused(t *testing.T) {
+	e := NewEngine(connmanager.NewConnectionManager())
+	if err := e.Start(parse(t, "spread=1h interval=1h")); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Cancel()
+	if err := e.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	// pausedAgo pretends the drain was paused d ago and returns the deadline
+	pausedAgo := func(d time.Duration) time.Time {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.pausedAt = time.Now().Add(-d)
+		return e.deadline
+	}
+	// The drain ran for 20 minutes before it was paused
+	e.mu.Lock()
+	e.deadline = time.Now().Add(40 * time.Minute)
+	e.mu.Unlock()
+	deadline := func() time.Time {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.deadline
+	}
+	near := func(got, want time.Time) bool {
+		return got.Sub(want).Abs() < time.Second
+	}
+
+	// A retune that sets no duration keeps the deadline, the pause still
+	// extends it once
+	before := pausedAgo(10 * time.Minute)
+	if err := e.Update(parse(t, "strategy=newest")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if got := deadline(); !near(got, before.Add(10*time.Minute)) {
+		t.Errorf("deadline moved by %s, want 10m", got.Sub(before))
+	}
+
+	// A new duration runs from the retune, the time paused before it is
+	// not added on top
+	if err := e.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	pausedAgo(10 * time.Minute)
+	retuned := time.Now()
+	if err := e.Update(parse(t, "spread=2h")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if got := deadline(); !near(got, retuned.Add(2*time.Hour)) {
+		t.Errorf("deadline %s after the retune, want 2h", got.Sub(retuned))
+	}
+}
+
+func TestRetuneWithoutDrain(t *testing.T) {
+	e := NewEngine(connmanager.NewConnectionManager())
+	if err := e.Update(parse(t, "rate=5")); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Update without a drain: %v, want ErrNotRunning", err)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	tests := []struct {
+		plan      Plan
+		remaining int
+		left      time.Duration
+		want      int
+	}{
+		// Percent applies to the count the plan started with
+		{Plan{Mode: ModePercent, Percent: 5, base: 1000}, 1000, 0, 50},
+		{Plan{Mode: ModePercent, Percent: 5, base: 1000}, 120, 0, 50},
+		{Plan{Mode: ModePercent, Percent: 5, base: 1000}, 30, 0, 30},
+		{Plan{Mode: ModePercent, Percent: 10, base: 3}, 3, 0, 1},
+		{Plan{Mode: ModeRate, Count: 4}, 100, 0, 4},
+		{Plan{Mode: ModeSpread, Interval: time.Second}, 100, 10 * time.Second, 10},
+		{Plan{Mode: ModeSpread, Interval: time.Second}, 100, 0, 100},
+		{Plan{Mode: ModeRate, Count: 4}, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.plan.batchSize(tt.remaining, tt.left); got != tt.want {
+			t.Errorf("%s with %d left: batch %d, want %d", tt.plan, tt.remaining, got, tt.want)
+		}
+	}
+}
+
+func TestCompletedDrainStaysOutOfRotation(t *testing.T) {
+	cm := connmanager.NewConnectionManager()
+	e := NewEngine(cm)
+	if err := e.Start(parse(t, "rate=5 interval=1ms")); err != nil {
+		t.Fatal(err)
+	}
+	<-e.Done()
+	if state := e.Status().State; state != StateCompleted {
+		t.Fatalf("state %s, want completed", state)
+	}
+	if !cm.Draining() {
+		t.Error("server back in rotation after the drain completed")
+	}
+	if err := e.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Draining() {
+		t.Error("server still draining after cancel")
+	}
+
+	if err := e.Start(parse(t, "rate=5 interval=1h")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Draining() || e.Status().State != StateCancelled {
+		t.Error("cancelled drain left the server out of rotation")
+	}
+}
@@ -0,0 +1,199 @@
+package drain
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+)
+
+// Mode selects how a plan sizes each batch of closes
+type Mode string
+
+const (
+	// ModePercent closes Percent of the connections the plan started with
+	// every Interval
+	ModePercent Mode = "percent"
+	// ModeRate closes Count connections every Interval until none are left
+	ModeRate Mode = "rate"
+	// ModeSpread spreads all closes evenly over Duration, one batch per Interval
+	ModeSpread Mode = "spread"
+)
+
+const defaultInterval = time.Second
+
+// ErrInvalidPlan is returned for plans that cannot be run
+var ErrInvalidPlan = errors.New("invalid drain plan")
+
+// Plan describes a progressive drain. Zero fields are not set: a started
+// plan falls back to the defaults, a retune keeps the running plan's values.
+type Plan struct {
+	Mode     Mode
+	Percent  float64
+	Count    int
+	Interval time.Duration
+	Duration time.Duration
+	Strategy connmanager.Strategy
+	// Close decides how connections with in-flight operations are closed
+	Close connmanager.CloseOptions
+
+	// base is the connection count Percent applies to: the count when the
+	// plan started or a retune set its mode or percent, so batches keep
+	// their size instead of shrinking with the connections left
+	base int
+}
+
+func (p Plan) Validate() error {
+	if p.Interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	switch p.Mode {
+	case ModePercent:
+		if p.Percent <= 0 || p.Percent > 100 {
+			return errors.New("percent must be in (0, 100]")
+		}
+	case ModeRate:
+		if p.Count <= 0 {
+			return errors.New("count must be positive")
+		}
+	case ModeSpread:
+		if p.Duration <= 0 {
+			return errors.New("duration must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown drain mode %q", p.Mode)
+	}
+	return nil
+}
+
+func (p Plan) String() string {
+	switch p.Mode {
+	case ModePercent:
+		return fmt.Sprintf("close %g%% every %s", p.Percent, p.Interval)
+	case ModeRate:
+		return fmt.Sprintf("close %d every %s", p.Count, p.Interval)
+	case ModeSpread:
+		return fmt.Sprintf("close all over %s in steps of %s", p.Duration, p.Interval)
+	}
+	return string(p.Mode)
+}
+
+// withDefaults fills in the interval and strategy a plan did not set
+func (p Plan) withDefaults(strategy connmanager.Strategy) Plan {
+	if p.Interval == 0 {
+		p.Interval = defaultInterval
+	}
+	if p.Strategy == nil {
+		p.Strategy = strategy
+	}
+	return p
+}
+
+// merge returns p with the fields update sets replaced, as a retune applies
+// it to the running plan
+func (p Plan) merge(update Plan) Plan {
+	if update.Mode != "" {
+		p.Mode = update.Mode
+		p.Percent, p.Count, p.Duration = update.Percent, update.Count, update.Duration
+	} else {
+		// Same mode, e.g. {"count":20} speeds up a rate plan
+		if update.Percent != 0 {
+			p.Percent = update.Percent
+		}
+		if update.Count != 0 {
+			p.Count = update.Count
+		}
+		if update.Duration != 0 {
+			p.Duration = update.Duration
+		}
+	}
+	if update.Interval != 0 {
+		p.Interval = update.Interval
+	}
+	if update.Strategy != nil {
+		p.Strategy = update.Strategy
+	}
+	if update.Close.Policy != "" {
+		p.Close.Policy = update.Close.Policy
+	}
+	if update.Close.Timeout != 0 {
+		p.Close.Timeout = update.Close.Timeout
+	}
+	if update.Close.Reconnect.Endpoint != "" {
+		p.Close.Reconnect.Endpoint = update.Close.Reconnect.Endpoint
+	}
+	return p
+}
+
+// batchSize returns how many connections to close on this tick given the
+// current count and the time left until the plan's deadline
+func (p Plan) batchSize(remaining int, left time.Duration) int {
+	if remaining <= 0 {
+		return 0
+	}
+	switch p.Mode {
+	case ModePercent:
+		return min(remaining, max(1, int(math.Ceil(float64(p.base)*p.Percent/100))))
+	case ModeRate:
+		return p.Count
+	case ModeSpread:
+		ticks := int(math.Ceil(float64(left) / float64(p.Interval)))
+		if ticks <= 1 {
+			return remaining
+		}
+		return int(math.Ceil(float64(remaining) / float64(ticks)))
+	}
+	return 0
+}
+
+// ParsePlan parses the "key=value" arguments of a drain or retune command,
+// e.g.
+//
+//	percent=5 interval=2s
+//	rate=10 interval=1s strategy=idle
+//	spread=180s inflight=wait wait=10s
+//	rate=10 endpoint=wss://other.example.com
+//
+// Keys that are not given stay zero, Engine.Start and Engine.Update decide
+// what they mean and validate the result.
+func ParsePlan(args []string) (Plan, error) {
+	var plan Plan
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return Plan{}, fmt.Errorf("invalid drain argument %q, expected key=value", arg)
+		}
+		var err error
+		switch key {
+		case "percent":
+			plan.Mode = ModePercent
+			plan.Percent, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		case "rate":
+			plan.Mode = ModeRate
+			plan.Count, err = strconv.Atoi(value)
+		case "spread":
+			plan.Mode = ModeSpread
+			plan.Duration, err = time.ParseDuration(value)
+		case "interval":
+			plan.Interval, err = time.ParseDuration(value)
+		case "strategy":
+			plan.Strategy, err = connmanager.StrategyByName(value)
+		case "inflight":
+			plan.Close.Policy, err = connmanager.ParseInFlightPolicy(value)
+		case "wait":
+			plan.Close.Timeout, err = time.ParseDuration(value)
+		case "endpoint":
+			plan.Close.Reconnect.Endpoint = value
+		default:
+			err = errors.New("unknown key")
+		}
+		if err != nil {
+			return Plan{}, fmt.Errorf("invalid drain argument %q: %w", arg, err)
+		}
+	}
+	return plan, nil
+}
@@ -6,17 +6,23 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/protocol"
+	"github.com/ArditZubaku/go-node-ws/internal/router"
+	"github.com/ArditZubaku/go-node-ws/internal/session"
 	"github.com/gorilla/websocket"
 )
 
-func RootHandler(cm *connmanager.ConnectionManager) http.HandlerFunc {
+// RootHandler serves WebSocket upgrades and answers plain HTTP requests.
+// Messages on its connections are handled by rt.
+func RootHandler(cm *connmanager.ConnectionManager, sessions *session.Manager, rt *router.Router) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Check if this is a WebSocket upgrade request
 		if websocket.IsWebSocketUpgrade(r) {
-			wsHandler(w, r, cm)
+			wsHandler(w, r, cm, sessions, rt)
 			return
 		}
 
@@ -35,9 +41,32 @@ func RootHandler(cm *connmanager.ConnectionManager) http.HandlerFunc {
 }
 
 func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, r, http.StatusOK, "healthy")
+}
+
+// LivezHandler reports whether the process is alive. It stays healthy while
+// connections drain during shutdown so the pod is not restarted mid-drain.
+func LivezHandler(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, r, http.StatusOK, "alive")
+}
+
+// ReadyzHandler reports whether the server wants new connections. It returns
+// 503 as soon as a shutdown signal arrives or a drain starts, so HAProxy and
+// the endpoints controller take the pod out of rotation.
+func ReadyzHandler(cm *connmanager.ConnectionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cm.Draining() {
+			writeProbe(w, r, http.StatusServiceUnavailable, "draining")
+			return
+		}
+		writeProbe(w, r, http.StatusOK, "ready")
+	}
+}
+
+func writeProbe(w http.ResponseWriter, r *http.Request, code int, status string) {
 	// Only log health checks at debug level to reduce noise
 	slog.Debug(
-		"HealthzHandler received request:",
+		"Probe received request:",
 		"method", r.Method,
 		"path", r.URL.Path,
 		"remote_addr", r.RemoteAddr,
@@ -52,28 +81,41 @@ func HealthzHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(code)
 
 	response := map[string]any{
-		"status":    "healthy",
+		"status":    status,
 		"timestamp": time.Now().Unix(),
 	}
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		slog.Error("Failed to encode health response", "error", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		slog.Error("Failed to encode probe response", "error", err)
 		return
 	}
 }
 
 // WebSocket upgrader
 var upgrader = websocket.Upgrader{
+	Subprotocols: protocol.Subprotocols,
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins for testing
 	},
 }
 
-func wsHandler(w http.ResponseWriter, r *http.Request, cm *connmanager.ConnectionManager) {
+// welcome is the payload of the json.v1 welcome notice. Seq is the sequence
+// number of the next message the client receives.
+type welcome struct {
+	Message string `json:"message"`
+	Session string `json:"session"`
+	Seq     uint64 `json:"seq"`
+	Resumed bool   `json:"resumed"`
+}
+
+// wsHandler serves one WebSocket connection. A client resumes a session by
+// connecting with "?resume=<token>", optionally with "&last=<seq>" naming the
+// last message it received; the buffered messages after it are replayed.
+// json.v1 clients get the welcome and session in a single welcome notice.
+func wsHandler(w http.ResponseWriter, r *http.Request, cm *connmanager.ConnectionManager, sessions *session.Manager, rt *router.Router) {
 	// Upgrade HTTP connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -82,21 +124,76 @@ func wsHandler(w http.ResponseWriter, r *http.Request, cm *connmanager.Connectio
 	}
 
 	// Add connection to manager
-	cm.AddConnection(conn)
+	c := cm.AddConnection(conn, r)
+
+	query := r.URL.Query()
+	sess, resumed := sessions.Open(query.Get("resume"))
+	c.SetResumeToken(sess.Token())
 
 	// Ensure connection is cleaned up
 	defer func() {
-		cm.RemoveConnection(conn)
-		conn.Close()
+		cm.RemoveConnection(c)
+		c.Close()
+		sessions.Suspend(sess)
 	}()
 
-	// Send welcome message
-	if err := conn.WriteMessage(websocket.TextMessage, []byte("WebSocket connection established")); err != nil {
-		slog.Error("Failed to send welcome message", "error", err)
-		return
+	// Announce the session and replay what the client missed
+	last := sess.Acked()
+	if resumed {
+		if v := query.Get("last"); v != "" {
+			if seq, err := strconv.ParseUint(v, 10, 64); err == nil {
+				last = seq
+			}
+		}
+	}
+	missed := sess.Since(last)
+	greeting := [][]byte{
+		[]byte("WebSocket connection established"),
+		fmt.Appendf(nil, "SESSION %s %d", sess.Token(), sess.NextSeq()),
+	}
+	if c.Protocol == protocol.JSON {
+		greeting = [][]byte{protocol.Notice(protocol.TypeWelcome, welcome{
+			Message: "WebSocket connection established",
+			Session: sess.Token(),
+			Seq:     sess.NextSeq(),
+			Resumed: resumed,
+		})}
+	}
+	for _, data := range greeting {
+		if err := c.Send(websocket.TextMessage, data); err != nil {
+			slog.Error("Failed to send welcome message", "id", c.ID, "error", err)
+			return
+		}
+	}
+	if resumed {
+		slog.Info("WebSocket session resumed", "id", c.ID, "replayed", len(missed))
+	}
+	for _, m := range missed {
+		if err := c.Send(m.Type, m.Data); err != nil {
+			slog.Error("Failed to replay message", "id", c.ID, "seq", m.Seq, "error", err)
+			return
+		}
 	}
 
-	// Simple message handling loop - NO TIMEOUTS, NO PANIC RECOVERY
+	// send buffers a reply in the session before writing it, so a reply
+	// lost to a close is replayed after the client resumes. The reply is
+	// encoded with the sequence number it is buffered under.
+	send := func(messageType int, encode func(seq uint64) ([]byte, error)) error {
+		data, err := sess.RecordWith(messageType, encode)
+		if err != nil {
+			return err
+		}
+		return c.Send(messageType, data)
+	}
+
+	dispatcher := rt.NewDispatcher(r.Context(), c, send)
+	dispatcher.HandleAck(sess.Ack)
+	defer dispatcher.Close()
+
+	// Simple message handling loop - NO PANIC RECOVERY. Reads time out when
+	// the peer stops answering pings, see connmanager.KeepaliveOptions.
+	// Messages are handled one at a time, a slow operation holds up the
+	// ones behind it and the pongs, so the keepalive restarts after each.
 	for {
 		select {
 		case <-cm.Shutdown:
@@ -108,53 +205,22 @@ func wsHandler(w http.ResponseWriter, r *http.Request, cm *connmanager.Connectio
 			if err != nil {
 				// Connection closed or error occurred
 				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-					slog.Info("WebSocket connection closed normally")
+					slog.Info("WebSocket connection closed normally", "id", c.ID)
 				} else {
-					slog.Info("WebSocket connection error", "error", err)
+					slog.Info("WebSocket connection error", "id", c.ID, "error", err)
 				}
+				c.MarkReadError(err)
 				return
 			}
+			c.RecordInbound(len(message))
 
-			slog.Info("Received message", "message", string(message))
-
-			// Check if this is a slow request
-			if string(message) == "SLOW_REQUEST" || string(message)[:9] == "SLOW_PING" {
-				slog.Info("Processing slow request via WebSocket...")
-
-				// Simulate slow work with shutdown awareness
-				ticker := time.NewTicker(1 * time.Second)
-				defer ticker.Stop()
-
-				startTime := time.Now()
-				for elapsed := time.Duration(0); elapsed < 30*time.Second; elapsed = time.Since(startTime) {
-					select {
-					case <-cm.Shutdown:
-						slog.Info("Slow WebSocket request interrupted by shutdown", "elapsed", elapsed)
-						response := fmt.Sprintf("SLOW_INTERRUPTED: Request interrupted by server shutdown after %.1f seconds", elapsed.Seconds())
-						if err := conn.WriteMessage(messageType, []byte(response)); err != nil {
-							slog.Error("Failed to write interruption message", "error", err)
-						}
-						return
-					case <-ticker.C:
-						// Continue waiting
-					}
-				}
+			slog.Info("Received message", "id", c.ID, "message", string(message))
 
-				response := fmt.Sprintf("SLOW_COMPLETE: Slow operation completed after 30 seconds at %s", time.Now().Format(time.RFC3339))
-				if err := conn.WriteMessage(messageType, []byte(response)); err != nil {
-					slog.Error("Failed to write slow response", "error", err)
-					return
-				}
-				slog.Info("Slow WebSocket operation completed")
-			} else {
-				// Regular echo response
-				response := "Echo: " + string(message)
-				if err := conn.WriteMessage(messageType, []byte(response)); err != nil {
-					slog.Error("Failed to write echo", "error", err)
-					return
-				}
-				slog.Info("Sent echo back to client")
+			if err := dispatcher.Dispatch(messageType, message); err != nil {
+				slog.Error("Failed to write reply", "id", c.ID, "error", err)
+				return
 			}
+			c.Handled()
 		}
 	}
 }
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/router"
+	"github.com/ArditZubaku/go-node-ws/internal/session"
+	"github.com/gorilla/websocket"
+)
+
+func TestSlowRequestOutlastsKeepalive(t *testing.T) {
+	cm := connmanager.NewConnectionManager()
+	cm.SetKeepaliveOptions(connmanager.KeepaliveOptions{
+		PingInterval: 50 * time.Millisecond,
+		PongTimeout:  50 * time.Millisecond,
+		IdleTimeout:  100 * time.Millisecond,
+	})
+	rt := router.New(cm)
+	rt.HandlePrefix("", router.Echo)
+	rt.HandlePrefix("SLOW_REQUEST", router.Slow(500*time.Millisecond))
+	srv := httptest.NewServer(RootHandler(cm, session.NewManager(session.NewMemoryStore(time.Minute), 16), rt))
+	t.Cleanup(srv.Close)
+
+	conn := dial(t, "ws"+strings.TrimPrefix(srv.URL, "http"))
+	readText(t, conn)
+	readText(t, conn)
+	conn.WriteMessage(websocket.TextMessage, []byte("SLOW_REQUEST"))
+
+	// The client answers pings while it reads, the server only sees the
+	// pongs once the operation ended
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("connection reaped during the slow request: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "SLOW_COMPLETE") {
+		t.Fatalf("reply %q", data)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("hi"))
+	if got := readText(t, conn); got != "Echo: hi" {
+		t.Errorf("reply after the slow request %q", got)
+	}
+	if reaped := cm.Reaped(); reaped != (connmanager.ReapedCounts{}) {
+		t.Errorf("reaped %+v", reaped)
+	}
+}
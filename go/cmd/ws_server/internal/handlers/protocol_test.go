@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/protocol"
+	"github.com/ArditZubaku/go-node-ws/internal/router"
+	"github.com/ArditZubaku/go-node-ws/internal/session"
+	"github.com/gorilla/websocket"
+)
+
+// server runs the WebSocket handler with the echo and slow routes
+func server(t *testing.T) (*connmanager.ConnectionManager, string) {
+	t.Helper()
+	cm := connmanager.NewConnectionManager()
+	rt := router.New(cm)
+	rt.HandlePrefix("", router.Echo)
+	rt.HandleType("echo", router.Echo)
+	rt.HandleType("slow_request", router.Slow(time.Minute))
+	sessions := session.NewManager(session.NewMemoryStore(time.Minute), 16)
+	srv := httptest.NewServer(RootHandler(cm, sessions, rt))
+	t.Cleanup(srv.Close)
+	return cm, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dial(t *testing.T, url string, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// envelope is a message received from the server
+type envelope struct {
+	ID      json.RawMessage `json:"id"`
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq"`
+	Payload json.RawMessage `json:"payload"`
+	Stream  bool            `json:"stream"`
+	Error   *protocol.Error `json:"error"`
+}
+
+func read(t *testing.T, conn *websocket.Conn) envelope {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatalf("not an envelope: %s", data)
+	}
+	return env
+}
+
+func readText(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestNegotiation(t *testing.T) {
+	_, url := server(t)
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		{nil, protocol.Text},
+		{[]string{protocol.Text}, protocol.Text},
+		{[]string{protocol.JSON}, protocol.JSON},
+		{[]string{"mqtt", protocol.JSON, protocol.Text}, protocol.JSON},
+		{[]string{"mqtt"}, protocol.Text},
+	}
+	for _, tt := range tests {
+		conn := dial(t, url, tt.offered...)
+		greeting := readText(t, conn)
+		if got := protocol.Negotiated(conn.Subprotocol()); got != tt.want {
+			t.Errorf("offered %q: negotiated %q, want %q", tt.offered, got, tt.want)
+		}
+		if json.Valid([]byte(greeting)) != (tt.want == protocol.JSON) {
+			t.Errorf("offered %q: greeting %q", tt.offered, greeting)
+		}
+		conn.Close()
+	}
+}
+
+func TestTextProtocolUnchanged(t *testing.T) {
+	cm, url := server(t)
+	conn := dial(t, url)
+	if got := readText(t, conn); got != "WebSocket connection established" {
+		t.Errorf("welcome %q", got)
+	}
+	if got := readText(t, conn); !strings.HasPrefix(got, "SESSION ") || !strings.HasSuffix(got, " 1") {
+		t.Errorf("session %q", got)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("ACK 1"))
+	conn.WriteMessage(websocket.TextMessage, []byte("hi"))
+	if got := readText(t, conn); got != "Echo: hi" {
+		t.Errorf("reply %q, want Echo: hi", got)
+	}
+
+	// Admin messages are marked, they are not numbered like replies
+	cm.SendTo(connmanager.Filter{}, connmanager.AdminMessage{Type: websocket.TextMessage, Data: []byte("moving soon")})
+	if got := readText(t, conn); got != "ADMIN: moving soon" {
+		t.Errorf("admin message %q", got)
+	}
+}
+
+func TestJSONProtocol(t *testing.T) {
+	_, url := server(t)
+	conn := dial(t, url, protocol.JSON)
+
+	welcome := read(t, conn)
+	var w struct {
+		Session string `json:"session"`
+		Seq     uint64 `json:"seq"`
+	}
+	json.Unmarshal(welcome.Payload, &w)
+	if welcome.Type != protocol.TypeWelcome || w.Session == "" || w.Seq != 1 {
+		t.Fatalf("welcome %+v", welcome)
+	}
+
+	tests := []struct {
+		send      string
+		id        string
+		typ       string
+		payload   string
+		errorCode string
+	}{
+		{`{"id":"a1","type":"echo","payload":{"n":1}}`, `"a1"`, "echo", `{"n":1}`, ""},
+		{`{"id":7,"type":"echo","payload":"hi","ack":1}`, `7`, "echo", `"hi"`, ""},
+		{`{"type":"echo"}`, ``, "echo", `null`, ""},
+		{`{"id":"a2","type":"nope"}`, `"a2"`, "nope", ``, router.CodeUnknownType},
+		{`{"id":"a3","payload":1}`, `"a3"`, protocol.TypeError, ``, router.CodeInvalidMessage},
+		{`hello`, ``, protocol.TypeError, ``, router.CodeInvalidMessage},
+		{`[1,2]`, ``, protocol.TypeError, ``, router.CodeInvalidMessage},
+	}
+	for i, tt := range tests {
+		conn.WriteMessage(websocket.TextMessage, []byte(tt.send))
+		got := read(t, conn)
+		if string(got.ID) != tt.id || got.Type != tt.typ {
+			t.Errorf("%s: id %s type %q, want id %s type %q", tt.send, got.ID, got.Type, tt.id, tt.typ)
+		}
+		// Every reply is numbered, from the welcome's seq on
+		if got.Seq != uint64(i+1) {
+			t.Errorf("%s: seq %d, want %d", tt.send, got.Seq, i+1)
+		}
+		if tt.errorCode != "" {
+			if got.Error == nil || got.Error.Code != tt.errorCode {
+				t.Errorf("%s: error %+v, want %s", tt.send, got.Error, tt.errorCode)
+			}
+			continue
+		}
+		if got.Error != nil || string(got.Payload) != tt.payload {
+			t.Errorf("%s: payload %s error %+v, want %s", tt.send, got.Payload, got.Error, tt.payload)
+		}
+	}
+
+	// An ack alone is not answered, the next reply is the binary error
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"ack":3}`))
+	conn.WriteMessage(websocket.BinaryMessage, []byte("raw"))
+	if got := read(t, conn); got.Error == nil || got.Error.Code != router.CodeInvalidMessage {
+		t.Errorf("binary message: %+v, want an invalid_message error", got)
+	}
+}
+
+func TestJSONNotices(t *testing.T) {
+	cm, url := server(t)
+	conn := dial(t, url, protocol.JSON)
+	read(t, conn)
+
+	// Admin messages arrive as message notices
+	cm.SendTo(connmanager.Filter{}, connmanager.AdminMessage{Type: websocket.TextMessage, Data: []byte(`{"maintenance":true}`), JSON: true})
+	cm.SendTo(connmanager.Filter{}, connmanager.AdminMessage{Type: websocket.TextMessage, Data: []byte("maintenance at noon")})
+	if got := read(t, conn); got.Type != protocol.TypeMessage || got.Seq != 0 || string(got.Payload) != `{"maintenance":true}` {
+		t.Errorf("json admin message %+v", got)
+	}
+	if got := read(t, conn); got.Type != protocol.TypeMessage || string(got.Payload) != `"maintenance at noon"` {
+		t.Errorf("text admin message %+v", got)
+	}
+
+	// An interrupted request is answered before the drain notice and the
+	// close frame
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"s1","type":"slow_request"}`))
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if c := cm.Connections(); len(c) == 1 && c[0].InFlight() == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slow request not started")
+		}
+	}
+	id := cm.Connections()[0].ID
+	go cm.CloseConnection(id, connmanager.CloseOptions{Policy: connmanager.PolicyInterrupt})
+
+	reply := read(t, conn)
+	var result struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(reply.Payload, &result)
+	if string(reply.ID) != `"s1"` || reply.Seq != 1 || result.Status != "interrupted" || result.Reason != "admin kick" {
+		t.Errorf("slow reply %+v, want it interrupted by admin kick", reply)
+	}
+	notice := read(t, conn)
+	var advisory connmanager.Advisory
+	json.Unmarshal(notice.Payload, &advisory)
+	if notice.Type != protocol.TypeDrain || notice.ID != nil || notice.Seq != 0 || advisory.Reason != connmanager.AdviseRebalance {
+		t.Errorf("notice %+v, want a drain notice", notice)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("read after the notice: %v, want a going away close", err)
+	}
+}
+
+func TestJSONShutdownNotice(t *testing.T) {
+	cm, url := server(t)
+	conn := dial(t, url, protocol.JSON)
+	read(t, conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go cm.CloseAllConnections(ctx)
+	notice := read(t, conn)
+	var advisory connmanager.Advisory
+	json.Unmarshal(notice.Payload, &advisory)
+	if notice.Type != protocol.TypeShutdown || advisory.Reason != connmanager.AdviseShutdown {
+		t.Errorf("notice %+v, want a shutdown notice", notice)
+	}
+}
+
+func TestJSONReplayKeepsSeq(t *testing.T) {
+	_, url := server(t)
+	conn := dial(t, url, protocol.JSON)
+	var w struct {
+		Session string `json:"session"`
+		Seq     uint64 `json:"seq"`
+		Resumed bool   `json:"resumed"`
+	}
+	json.Unmarshal(read(t, conn).Payload, &w)
+	for _, payload := range []string{`"a"`, `"b"`} {
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"echo","payload":`+payload+`}`))
+		read(t, conn)
+	}
+	conn.Close()
+	token := w.Session
+
+	// The session is suspended once the server noticed the close
+	var resumed *websocket.Conn
+	for deadline := time.Now().Add(2 * time.Second); !w.Resumed; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("session not resumed")
+		}
+		resumed = dial(t, url+"?resume="+token+"&last=1", protocol.JSON)
+		json.Unmarshal(read(t, resumed).Payload, &w)
+	}
+	if w.Seq != 2 {
+		t.Errorf("welcome seq %d after resuming, want 2", w.Seq)
+	}
+	if got := read(t, resumed); got.Seq != 2 || string(got.Payload) != `"b"` {
+		t.Errorf("replayed %+v, want the reply numbered 2", got)
+	}
+}
@@ -3,82 +3,77 @@ package http
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"net"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
 	"github.com/ArditZubaku/go-node-ws/internal/handlers"
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+	"github.com/ArditZubaku/go-node-ws/internal/router"
+	"github.com/ArditZubaku/go-node-ws/internal/session"
+	"github.com/ArditZubaku/go-node-ws/internal/shutdown"
 )
 
+// Config holds the listener settings
+type Config struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+}
+
 type Server struct {
 	cm   *connmanager.ConnectionManager
 	http *http.Server
 	mux  *http.ServeMux
 }
 
-func NewServer(cm *connmanager.ConnectionManager) *Server {
+// NewServer builds the server. Messages on its WebSocket connections are
+// handled by rt.
+func NewServer(cfg Config, cm *connmanager.ConnectionManager, orch *shutdown.Orchestrator, sessions *session.Manager, rt *router.Router) *Server {
 	mux := http.NewServeMux()
 
 	s := &Server{
 		cm:  cm,
 		mux: mux,
 		http: &http.Server{
-			Addr:         ":8080",
 			Handler:      mux,
-			ReadTimeout:  10 * time.Second,
-			WriteTimeout: 10 * time.Second,
-			IdleTimeout:  60 * time.Second,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
 		},
 	}
 
 	// Routes
-	mux.HandleFunc("/", handlers.RootHandler(cm))
+	mux.HandleFunc("/", handlers.RootHandler(cm, sessions, rt))
 	mux.HandleFunc("/healthz", handlers.HealthzHandler)
+	mux.HandleFunc("/readyz", handlers.ReadyzHandler(cm))
+	mux.HandleFunc("/livez", handlers.LivezHandler)
 	mux.HandleFunc("/connections-count", handlers.ConnectionsCountHandler(cm))
-
-	// WebSocket cleanup when server shuts down
-	s.http.RegisterOnShutdown(func() {
-		slog.Info("Closing all WebSocket connections...")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		s.cm.CloseAllConnections(ctx)
+	mux.HandleFunc("/metrics", metrics.Default.Handler())
+
+	// Stop accepting new connections and upgrades. Hijacked WebSocket
+	// connections are not tracked by http.Server, the orchestrator drains
+	// and closes them in later phases.
+	orch.OnPhase(shutdown.PhaseStopAccepting, func(ctx context.Context, _ shutdown.Phase) {
+		slog.Info("Shutting down HTTP server...")
+		// The listener is already closed when it was handed over
+		if err := s.http.Shutdown(ctx); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("Forced shutdown", "error", err)
+		}
 	})
 
 	return s
 }
 
-func (s *Server) Start() {
-	ln, err := net.Listen("tcp", s.http.Addr)
-	if err != nil {
-		slog.Error("Failed to bind listener", "error", err)
-		os.Exit(1)
-	}
-
-	go s.handleShutdown()
-
-	slog.Info("HTTP Server starting", "addr", s.http.Addr)
+// Start serves HTTP on ln until the server is shut down or ln is handed over
+// by an upgrade
+func (s *Server) Start(ln net.Listener) {
+	slog.Info("HTTP Server starting", "addr", ln.Addr().String())
 
-	if err := s.http.Serve(ln); err != nil && err != http.ErrServerClosed {
+	if err := s.http.Serve(ln); err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
 		slog.Error("Server error", "error", err)
 	}
 }
-
-func (s *Server) handleShutdown() {
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-
-	<-sig
-	slog.Info("Shutdown signal received, shutting down HTTP server...")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if err := s.http.Shutdown(ctx); err != nil {
-		slog.Error("Forced shutdown", "error", err)
-	}
-}
@@ -0,0 +1,271 @@
+// Package metrics implements the small subset of Prometheus instrumentation
+// the server needs and exposes it in the text exposition format, without
+// pulling in the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type collector interface {
+	name() string
+	write(b *strings.Builder)
+}
+
+// Registry holds the metrics exposed by Handler
+type Registry struct {
+	mu         sync.RWMutex
+	collectors []collector
+}
+
+// Default is the registry the server's metrics are registered with
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if slices.ContainsFunc(r.collectors, func(e collector) bool { return e.name() == c.name() }) {
+		panic("metrics: duplicate metric " + c.name())
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText renders every registered metric in the Prometheus text format
+func (r *Registry) WriteText() string {
+	r.mu.RLock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.RUnlock()
+
+	slices.SortFunc(collectors, func(a, b collector) int {
+		return strings.Compare(a.name(), b.name())
+	})
+
+	var b strings.Builder
+	for _, c := range collectors {
+		c.write(&b)
+	}
+	return b.String()
+}
+
+// Handler serves the registry in the Prometheus text exposition format
+func (r *Registry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(r.WriteText())); err != nil {
+			slog.Error("Failed to write metrics response", "error", err)
+		}
+	}
+}
+
+type desc struct {
+	metricName string
+	help       string
+	typ        string
+	labels     []string
+}
+
+func (d desc) name() string {
+	return d.metricName
+}
+
+func (d desc) header(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, d.help, d.metricName, d.typ)
+}
+
+// sample writes one line, labelValues match d.labels by position
+func (d desc) sample(b *strings.Builder, labelValues []string, value float64) {
+	b.WriteString(d.metricName)
+	if len(d.labels) > 0 {
+		b.WriteByte('{')
+		for i, label := range d.labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", label, escapeLabel(labelValues[i]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatValue(value))
+	b.WriteByte('\n')
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	desc
+	value atomic.Uint64
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{desc: desc{metricName: name, help: help, typ: "counter"}}
+	Default.register(c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) write(b *strings.Builder) {
+	c.header(b)
+	c.sample(b, nil, float64(c.value.Load()))
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	desc
+	bits atomic.Uint64
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{desc: desc{metricName: name, help: help, typ: "gauge"}}
+	Default.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+func (g *Gauge) write(b *strings.Builder) {
+	g.header(b)
+	g.sample(b, nil, g.Value())
+}
+
+// GaugeFunc is a gauge whose value is read from fn at scrape time
+type GaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{metricName: name, help: help, typ: "gauge"}, fn: fn}
+	Default.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(b *strings.Builder) {
+	g.header(b)
+	g.sample(b, nil, g.fn())
+}
+
+// vec holds one value per combination of label values
+type vec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*atomic.Uint64
+	keys   map[string][]string
+}
+
+func newVec(d desc) vec {
+	return vec{desc: d, values: make(map[string]*atomic.Uint64), keys: make(map[string][]string)}
+}
+
+func (v *vec) with(labelValues []string) *atomic.Uint64 {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.metricName, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	value, ok := v.values[key]
+	if !ok {
+		value = new(atomic.Uint64)
+		v.values[key] = value
+		v.keys[key] = slices.Clone(labelValues)
+	}
+	return value
+}
+
+func (v *vec) write(b *strings.Builder, toFloat func(uint64) float64) {
+	v.header(b)
+
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		v.sample(b, v.keys[key], toFloat(v.values[key].Load()))
+	}
+	v.mu.Unlock()
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(desc{metricName: name, help: help, typ: "counter", labels: labels})}
+	Default.register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.with(labelValues).Add(1)
+}
+
+func (c *CounterVec) Add(n uint64, labelValues ...string) {
+	c.with(labelValues).Add(n)
+}
+
+func (c *CounterVec) write(b *strings.Builder) {
+	c.vec.write(b, func(v uint64) float64 { return float64(v) })
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	vec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(desc{metricName: name, help: help, typ: "gauge", labels: labels})}
+	Default.register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.with(labelValues).Store(math.Float64bits(v))
+}
+
+func (g *GaugeVec) write(b *strings.Builder) {
+	g.vec.write(b, math.Float64frombits)
+}
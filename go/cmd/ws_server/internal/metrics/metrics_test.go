@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := &Registry{}
+	closed := &CounterVec{newVec(desc{metricName: "b_closed_total", help: "Closed.", typ: "counter", labels: []string{"reason", "code"}})}
+	accepted := &Counter{desc: desc{metricName: "a_accepted_total", help: "Accepted.", typ: "counter"}}
+	phase := &GaugeVec{newVec(desc{metricName: "c_phase_seconds", help: "Phase duration.", typ: "gauge", labels: []string{"phase"}})}
+	active := &GaugeFunc{desc: desc{metricName: "d_active", help: "Active.", typ: "gauge"}, fn: func() float64 { return 3 }}
+	for _, c := range []collector{closed, accepted, phase, active} {
+		r.register(c)
+	}
+
+	accepted.Add(2)
+	closed.Inc("server drain", "1001")
+	closed.Add(4, "client", "1000")
+	closed.Inc("server drain", "1001")
+	closed.Inc("quote \" slash \\ newline \n", "1006")
+	phase.Set(1.5, "drain")
+	phase.Set(math.Inf(1), "close-frames")
+
+	want := `# HELP a_accepted_total Accepted.
+# TYPE a_accepted_total counter
+a_accepted_total 2
+# HELP b_closed_total Closed.
+# TYPE b_closed_total counter
+b_closed_total{reason="client",code="1000"} 4
+b_closed_total{reason="quote \" slash \\ newline \n",code="1006"} 1
+b_closed_total{reason="server drain",code="1001"} 2
+# HELP c_phase_seconds Phase duration.
+# TYPE c_phase_seconds gauge
+c_phase_seconds{phase="close-frames"} +Inf
+c_phase_seconds{phase="drain"} 1.5
+# HELP d_active Active.
+# TYPE d_active gauge
+d_active 3
+`
+	if got := r.WriteText(); got != want {
+		t.Errorf("WriteText() =\n%s\nwant\n%s", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	r.Handler()(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if rec.Body.String() != want {
+		t.Errorf("handler body differs from WriteText()")
+	}
+}
+
+func TestRegistryPanics(t *testing.T) {
+	expectPanic := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", name)
+			}
+		}()
+		fn()
+	}
+
+	r := &Registry{}
+	r.register(&Counter{desc: desc{metricName: "x_total"}})
+	expectPanic("duplicate registration", func() {
+		r.register(&Gauge{desc: desc{metricName: "x_total"}})
+	})
+
+	v := &CounterVec{newVec(desc{metricName: "y_total", labels: []string{"a", "b"}})}
+	expectPanic("wrong label count", func() { v.Inc("only one") })
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := map[float64]string{
+		0:            "0",
+		42:           "42",
+		0.25:         "0.25",
+		1e21:         "1e+21",
+		math.Inf(-1): "-Inf",
+		math.NaN():   "NaN",
+	}
+	for v, want := range tests {
+		if got := formatValue(v); got != want {
+			t.Errorf("formatValue(%v) = %q, want %q", v, got, want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package metrics
+
+// Series exported by the ws_server. Gauges that mirror live state, such as
+// the active connection count, are registered once with NewGaugeFunc in
+// main, where the server is wired together.
+var (
+	ConnectionsAccepted = NewCounter(
+		"ws_connections_accepted_total",
+		"WebSocket connections accepted.",
+	)
+	ConnectionsClosed = NewCounterVec(
+		"ws_connections_closed_total",
+		"WebSocket connections closed, by close code and reason.",
+		"code", "reason",
+	)
+	ConnectionsReaped = NewCounterVec(
+		"ws_connections_reaped_total",
+		"Connections closed by the keepalive, by reason (pong_timeout, idle_timeout).",
+		"reason",
+	)
+	Messages = NewCounterVec(
+		"ws_messages_total",
+		"WebSocket messages, by direction.",
+		"direction",
+	)
+	Bytes = NewCounterVec(
+		"ws_message_bytes_total",
+		"WebSocket message payload bytes, by direction.",
+		"direction",
+	)
+	RoutedMessages = NewCounterVec(
+		"ws_routed_messages_total",
+		"WebSocket messages dispatched by the router, by route (unknown when none matched).",
+		"route",
+	)
+	SlowOperations = NewCounterVec(
+		"ws_slow_operations_total",
+		"Slow operations, by outcome (started, completed, interrupted).",
+		"outcome",
+	)
+	SendQueueOverflows = NewCounterVec(
+		"ws_send_queue_overflows_total",
+		"Messages sent to a connection whose send queue was full, by overflow policy.",
+		"policy",
+	)
+	ProxyHeaders = NewCounterVec(
+		"ws_proxy_protocol_connections_total",
+		"Connections accepted on PROXY protocol listeners, by listener and header result (v1, v2, none, untrusted, rejected).",
+		"listener", "result",
+	)
+	TLSHandshakes = NewCounterVec(
+		"ws_tls_handshakes_total",
+		"Completed TLS handshakes on the WebSocket listener, by version and session resumption.",
+		"version", "resumed",
+	)
+	CertificateReloads = NewCounterVec(
+		"ws_tls_certificate_reloads_total",
+		"TLS certificate reloads after the files changed, by result (reloaded, failed).",
+		"result",
+	)
+	EventsDropped = NewCounter(
+		"ws_events_dropped_total",
+		"Lifecycle events dropped because a subscriber fell behind.",
+	)
+	ControlCommands = NewCounterVec(
+		"ws_control_commands_total",
+		"Control commands run from the service communication port or the admin API, by command.",
+		"command",
+	)
+	DrainActive = NewGauge(
+		"ws_drain_active",
+		"Whether a drain plan is running or paused.",
+	)
+	DrainClosed = NewGauge(
+		"ws_drain_closed_connections",
+		"Connections closed by the current or last drain plan.",
+	)
+	ShutdownPhaseDuration = NewGaugeVec(
+		"ws_shutdown_phase_duration_seconds",
+		"How long each completed shutdown phase took.",
+		"phase",
+	)
+)
@@ -0,0 +1,78 @@
+// Package protocol defines the WebSocket subprotocols the server speaks.
+// Clients pick one with the Sec-WebSocket-Protocol header: text.v1 is the
+// free text protocol, json.v1 wraps every message in an Envelope.
+package protocol
+
+import (
+	"encoding/json"
+)
+
+const (
+	// Text is the default protocol of free text messages such as
+	// "Echo: hi" and "SLOW_COMPLETE: ..."
+	Text = "text.v1"
+	// JSON carries every message as a JSON envelope
+	JSON = "json.v1"
+)
+
+// Subprotocols lists the protocols offered in the upgrade response. The
+// client's order of preference decides.
+var Subprotocols = []string{JSON, Text}
+
+// Negotiated returns the protocol of a connection from its negotiated
+// subprotocol, Text when the client did not ask for one
+func Negotiated(subprotocol string) string {
+	if subprotocol == JSON {
+		return JSON
+	}
+	return Text
+}
+
+// Notice types the server pushes without a request
+const (
+	TypeWelcome = "welcome"
+	// TypeDrain announces that the server closes the connection to move it
+	// to another replica
+	TypeDrain = "drain"
+	// TypeShutdown announces that the server closes the connection because
+	// it shuts down
+	TypeShutdown = "shutdown"
+	// TypeMessage carries an admin message
+	TypeMessage = "message"
+	// TypeError is the type of error replies to messages without a type
+	TypeError = "error"
+)
+
+// Request is a message received from a json.v1 client. Ack acknowledges
+// every message up to that sequence number, like "ACK <seq>" in text.v1;
+// a request may carry only an ack.
+type Request struct {
+	ID      json.RawMessage `json:"id,omitempty"`
+	Type    string          `json:"type,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Ack     *uint64         `json:"ack,omitempty"`
+}
+
+// Envelope is a message sent to a json.v1 client. Replies carry the ID of
+// their request, notices none. Seq numbers the replies the session buffers
+// for replay; notices are not buffered and carry no number.
+type Envelope struct {
+	ID      json.RawMessage `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Payload any             `json:"payload,omitempty"`
+	Stream  bool            `json:"stream,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error is the error of a failed request
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Notice encodes a message the server pushes, such as a drain notice
+func Notice(typ string, payload any) []byte {
+	data, _ := json.Marshal(Envelope{Type: typ, Payload: payload})
+	return data
+}
@@ -0,0 +1,281 @@
+// Package proxyproto reads HAProxy PROXY protocol v1 and v2 headers. A proxy
+// sends one at the start of every connection it opens to a backend, carrying
+// the address of the client it accepted the connection from, so the backend
+// sees the client instead of the proxy.
+//
+// See https://www.haproxy.org/download/3.0/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	// v1Prefix starts a human-readable v1 header
+	v1Prefix = []byte("PROXY ")
+	// v2Signature starts a binary v2 header
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// v1MaxLength is the longest v1 line, CRLF included
+	v1MaxLength = 107
+	// v2HeaderLength is the signature, version and command, family and
+	// length fields that precede the addresses
+	v2HeaderLength = 16
+)
+
+// TLV types defined by the specification
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+)
+
+// tlvNames names the TLV types in Info. Text types are shown as is, the
+// others hex encoded.
+var tlvNames = map[byte]struct {
+	name string
+	text bool
+}{
+	TypeALPN:      {"alpn", true},
+	TypeAuthority: {"authority", true},
+	TypeCRC32C:    {"crc32c", false},
+	TypeNoop:      {"noop", false},
+	TypeUniqueID:  {"unique_id", false},
+	TypeSSL:       {"ssl", false},
+	TypeNetNS:     {"netns", true},
+}
+
+var errInvalid = errors.New("invalid PROXY protocol header")
+
+// Header is a parsed PROXY protocol header. Source and Destination are nil
+// when the proxy sent no addresses, for a v1 UNKNOWN or a v2 LOCAL header,
+// e.g. on its own health checks.
+type Header struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+// TLV is a type-length-value field of a v2 header
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV returns the value of the first TLV of type t
+func (h *Header) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Info is a serializable view of a Header
+type Info struct {
+	Version     int               `json:"version"`
+	Source      string            `json:"source,omitempty"`
+	Destination string            `json:"destination,omitempty"`
+	TLVs        map[string]string `json:"tlvs,omitempty"`
+}
+
+func (h *Header) Info() Info {
+	info := Info{Version: h.Version}
+	if h.Source != nil {
+		info.Source = h.Source.String()
+	}
+	if h.Destination != nil {
+		info.Destination = h.Destination.String()
+	}
+	for _, tlv := range h.TLVs {
+		if info.TLVs == nil {
+			info.TLVs = make(map[string]string, len(h.TLVs))
+		}
+		known, ok := tlvNames[tlv.Type]
+		switch {
+		case ok && known.text:
+			info.TLVs[known.name] = string(tlv.Value)
+		case ok:
+			info.TLVs[known.name] = hex.EncodeToString(tlv.Value)
+		default:
+			info.TLVs[fmt.Sprintf("0x%02x", tlv.Type)] = hex.EncodeToString(tlv.Value)
+		}
+	}
+	return info
+}
+
+// match reports whether the buffered bytes start a header. more is true
+// while too few bytes are buffered to tell.
+func match(buffered []byte) (ok, more bool) {
+	for _, prefix := range [][]byte{v1Prefix, v2Signature} {
+		n := min(len(buffered), len(prefix))
+		if bytes.Equal(buffered[:n], prefix[:n]) {
+			if n == len(prefix) {
+				return true, false
+			}
+			more = true
+		}
+	}
+	return false, more
+}
+
+// detect peeks at br until it can tell whether a header follows
+func detect(br *bufio.Reader) (bool, error) {
+	n := 1
+	for {
+		if _, err := br.Peek(n); err != nil {
+			return false, err
+		}
+		buffered, _ := br.Peek(br.Buffered())
+		ok, more := match(buffered)
+		if !more {
+			return ok, nil
+		}
+		n = len(buffered) + 1
+	}
+}
+
+// read parses the header br starts with
+func read(br *bufio.Reader) (*Header, error) {
+	sig, err := br.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, v1Prefix) {
+		return readV1(br)
+	}
+	return readV2(br)
+}
+
+// readV1 parses a line such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443"
+func readV1(br *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == v1MaxLength {
+			return nil, fmt.Errorf("%w: v1 line too long", errInvalid)
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("%w: v1 line not terminated by CRLF", errInvalid)
+	}
+
+	fields := strings.Split(text, " ")
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", errInvalid, text)
+	}
+	src, err := v1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := v1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func v1Addr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil, fmt.Errorf("%w: bad address %q", errInvalid, host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad port %q", errInvalid, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 parses a binary header
+func readV2(br *bufio.Reader) (*Header, error) {
+	head := make([]byte, v2HeaderLength)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head[:len(v2Signature)], v2Signature) {
+		return nil, fmt.Errorf("%w: bad signature", errInvalid)
+	}
+	if version := head[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("%w: version %d", errInvalid, version)
+	}
+	command := head[12] & 0x0f
+	family := head[13]
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	var addrLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		addrLen = 12
+	case 0x21: // TCP over IPv6
+		addrLen = 36
+	case 0x31: // stream over UNIX sockets
+		addrLen = 216
+	}
+	if len(body) < addrLen {
+		return nil, fmt.Errorf("%w: %d address bytes for family 0x%02x", errInvalid, len(body), family)
+	}
+
+	switch command {
+	case 0x0: // LOCAL, the proxy's own connection
+	case 0x1: // PROXY
+		switch family {
+		case 0x11:
+			h.Source = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+			h.Destination = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+		case 0x21:
+			h.Source = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+			h.Destination = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+		}
+	default:
+		return nil, fmt.Errorf("%w: command %d", errInvalid, command)
+	}
+
+	tlvs := body[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("%w: truncated TLV", errInvalid)
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, fmt.Errorf("%w: truncated TLV", errInvalid)
+		}
+		h.TLVs = append(h.TLVs, TLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		tlvs = tlvs[3+n:]
+	}
+	return h, nil
+}
@@ -0,0 +1,217 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+)
+
+// Mode decides whether trusted sources must send a header
+type Mode string
+
+const (
+	// ModeOff reads no headers
+	ModeOff Mode = "off"
+	// ModeOptional uses a header when a trusted source sends one
+	ModeOptional Mode = "optional"
+	// ModeStrict closes connections from trusted sources that send none
+	ModeStrict Mode = "strict"
+)
+
+// ParseMode parses a Mode name, empty meaning off
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(s)); m {
+	case "":
+		return ModeOff, nil
+	case ModeOff, ModeOptional, ModeStrict:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown PROXY protocol mode %q (off, optional, strict)", s)
+	}
+}
+
+// ParsePrefixes parses a list of CIDRs. A bare address is a single host.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", s)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Config controls how a Listener reads headers
+type Config struct {
+	Mode Mode
+	// Trusted lists the networks allowed to send a header, empty trusts
+	// every source. Headers from other sources are not read, they reach the
+	// application as data and fail its protocol.
+	Trusted []netip.Prefix
+	// HeaderTimeout bounds the time to read the header
+	HeaderTimeout time.Duration
+}
+
+func (c Config) trusts(addr net.Addr) bool {
+	if len(c.Trusted) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcp.AddrPort().Addr().Unmap()
+	for _, prefix := range c.Trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener reads a PROXY protocol header from the connections it accepts
+type Listener struct {
+	net.Listener
+	name string
+	cfg  Config
+}
+
+// NewListener wraps ln to read headers as cfg says. name labels the
+// listener in logs and metrics. With ModeOff ln is returned as is.
+func NewListener(ln net.Listener, name string, cfg Config) net.Listener {
+	if cfg.Mode == ModeOff || cfg.Mode == "" {
+		return ln
+	}
+	return &Listener{Listener: ln, name: name, cfg: cfg}
+}
+
+// Accept returns the next connection. Its header is read on the first
+// Read or RemoteAddr call, so a slow client does not hold up the others.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, br: bufio.NewReader(conn), listener: l}, nil
+}
+
+// Conn is a connection accepted by a Listener. RemoteAddr is the client
+// address from the header when there is one.
+type Conn struct {
+	net.Conn
+	br       *bufio.Reader
+	listener *Listener
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the accepted connection
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Header returns the header the proxy sent, nil without one
+func (c *Conn) Header() *Header {
+	c.once.Do(c.readHeader)
+	return c.header
+}
+
+func (c *Conn) readHeader() {
+	cfg := c.listener.cfg
+	peer := c.Conn.RemoteAddr()
+	if !cfg.trusts(peer) {
+		metrics.ProxyHeaders.Inc(c.listener.name, "untrusted")
+		return
+	}
+
+	if cfg.HeaderTimeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(cfg.HeaderTimeout)); err != nil {
+			c.reject(peer, err)
+			return
+		}
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	present, err := detect(c.br)
+	switch {
+	case cfg.Mode == ModeStrict && err != nil:
+		c.reject(peer, err)
+		return
+	case cfg.Mode == ModeStrict && !present:
+		c.reject(peer, errors.New("no PROXY protocol header"))
+		return
+	case !present:
+		// Whatever stopped the detection, e.g. a client waiting for the
+		// server to speak first, is left to the application
+		metrics.ProxyHeaders.Inc(c.listener.name, "none")
+		return
+	}
+
+	h, err := read(c.br)
+	if err != nil {
+		c.reject(peer, err)
+		return
+	}
+	c.header = h
+	metrics.ProxyHeaders.Inc(c.listener.name, fmt.Sprintf("v%d", h.Version))
+}
+
+// reject fails the connection, every Read returns err from now on
+func (c *Conn) reject(peer net.Addr, err error) {
+	slog.Warn("Rejected connection without a valid PROXY protocol header", "listener", c.listener.name, "remote_addr", peer, "error", err)
+	metrics.ProxyHeaders.Inc(c.listener.name, "rejected")
+	c.err = fmt.Errorf("proxy protocol: %w", err)
+	c.Conn.Close()
+}
+
+// FromConn returns the header c, or a connection it wraps such as a TLS
+// connection, was accepted with. It is nil without one.
+func FromConn(c net.Conn) *Header {
+	for c != nil {
+		if pc, ok := c.(*Conn); ok {
+			return pc.Header()
+		}
+		wrapper, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		c = wrapper.NetConn()
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// accept returns the server side of a connection the client writes data on
+func accept(t *testing.T, cfg Config, data []byte) *Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	cfg.HeaderTimeout = time.Second
+	return &Conn{Conn: server, br: bufio.NewReader(server), listener: &Listener{name: "test", cfg: cfg}}
+}
+
+func v2Header(t *testing.T, tlvs ...TLV) []byte {
+	t.Helper()
+	var body bytes.Buffer
+	body.Write(net.ParseIP("192.0.2.7").To4())
+	body.Write(net.ParseIP("198.51.100.1").To4())
+	binary.Write(&body, binary.BigEndian, uint16(51234))
+	binary.Write(&body, binary.BigEndian, uint16(8080))
+	for _, tlv := range tlvs {
+		body.WriteByte(tlv.Type)
+		binary.Write(&body, binary.BigEndian, uint16(len(tlv.Value)))
+		body.Write(tlv.Value)
+	}
+	h := append([]byte{}, v2Signature...)
+	h = append(h, 0x21, 0x11)
+	h = binary.BigEndian.AppendUint16(h, uint16(body.Len()))
+	return append(h, body.Bytes()...)
+}
+
+func TestHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   Mode
+		data   []byte
+		remote string
+		rest   string
+	}{
+		{"v1", ModeStrict, []byte("PROXY TCP4 192.0.2.7 198.51.100.1 51234 8080\r\nGET / HTTP/1.1\r\n"), "192.0.2.7:51234", "GET / HTTP/1.1\r\n"},
+		{"v1 ipv6", ModeOptional, []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51234 8080\r\nhi"), "[2001:db8::7]:51234", "hi"},
+		{"v1 unknown", ModeStrict, []byte("PROXY UNKNOWN\r\nhi"), "pipe", "hi"},
+		{"v2", ModeStrict, append(v2Header(t, TLV{TypeAuthority, []byte("ws.example.com")}), "hi"...), "192.0.2.7:51234", "hi"},
+		{"optional without header", ModeOptional, []byte("GET / HTTP/1.1\r\n"), "pipe", "GET / HTTP/1.1\r\n"},
+		{"optional short message", ModeOptional, []byte("1\n"), "pipe", "1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := accept(t, Config{Mode: tt.mode}, tt.data)
+			if got := c.RemoteAddr().String(); got != tt.remote {
+				t.Errorf("RemoteAddr() = %s, want %s", got, tt.remote)
+			}
+			rest, err := io.ReadAll(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != tt.rest {
+				t.Errorf("read %q after the header, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestHeaderTLVs(t *testing.T) {
+	c := accept(t, Config{Mode: ModeStrict}, v2Header(t,
+		TLV{TypeAuthority, []byte("ws.example.com")},
+		TLV{TypeUniqueID, []byte{0xca, 0xfe}},
+		TLV{0xe0, []byte{0x01}},
+	))
+	info := c.Header().Info()
+	want := map[string]string{"authority": "ws.example.com", "unique_id": "cafe", "0xe0": "01"}
+	for k, v := range want {
+		if info.TLVs[k] != v {
+			t.Errorf("TLV %s = %q, want %q", k, info.TLVs[k], v)
+		}
+	}
+	if info.Destination != "198.51.100.1:8080" {
+		t.Errorf("destination = %s", info.Destination)
+	}
+}
+
+func TestStrictRejects(t *testing.T) {
+	for name, data := range map[string]string{
+		"missing":   "GET / HTTP/1.1\r\n\r\n",
+		"malformed": "PROXY TCP4 not-an-ip 198.51.100.1 1 2\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := accept(t, Config{Mode: ModeStrict}, []byte(data))
+			if _, err := c.Read(make([]byte, 1)); err == nil {
+				t.Error("Read succeeded on a rejected connection")
+			}
+		})
+	}
+}
+
+func TestUntrustedHeaderIsData(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.7 198.51.100.1 51234 8080\r\n"
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	c := accept(t, Config{Mode: ModeStrict, Trusted: trusted}, []byte(header))
+	if c.Header() != nil {
+		t.Error("header read from an untrusted source")
+	}
+	rest, _ := io.ReadAll(c)
+	if string(rest) != header {
+		t.Errorf("read %q, want the header passed through", rest)
+	}
+}
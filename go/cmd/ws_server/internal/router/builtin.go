@@ -0,0 +1,85 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// echoReply renders as "Echo: <message>" for text messages and as the
+// request payload for JSON envelopes
+type echoReply struct {
+	text    []byte
+	payload json.RawMessage
+}
+
+func (r echoReply) String() string {
+	return "Echo: " + string(r.text)
+}
+
+func (r echoReply) MarshalJSON() ([]byte, error) {
+	if len(r.payload) == 0 {
+		return []byte("null"), nil
+	}
+	return r.payload, nil
+}
+
+// Echo sends every message back to the client
+func Echo(m *Message) error {
+	if err := m.Reply(echoReply{text: m.Data, payload: json.RawMessage(m.Payload)}); err != nil {
+		return err
+	}
+	slog.Info("Sent echo back to client", "id", m.d.connID())
+	return nil
+}
+
+// slowResult reports how a slow operation ended
+type slowResult struct {
+	Status   string `json:"status"`
+	Reason   string `json:"reason,omitempty"`
+	Duration string `json:"duration"`
+	// elapsed is Duration for the text reply
+	elapsed time.Duration
+	// at is when the operation completed
+	at time.Time
+}
+
+func (r slowResult) String() string {
+	if r.Status == "interrupted" {
+		return fmt.Sprintf("SLOW_INTERRUPTED: Request interrupted by %s after %.1f seconds", r.Reason, r.elapsed.Seconds())
+	}
+	return fmt.Sprintf("SLOW_COMPLETE: Slow operation completed after %s at %s", r.Duration, r.at.Format(time.RFC3339))
+}
+
+// Slow simulates an operation that takes duration. It runs as in-flight
+// work and stops early when it is interrupted by a drain, a kick or the
+// shutdown.
+func Slow(duration time.Duration) Handler {
+	return func(m *Message) error {
+		slog.Info("Processing slow request via WebSocket...")
+		m.Begin("slow_request")
+
+		start := time.Now()
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+
+		result := slowResult{Status: "completed", Duration: duration.String(), elapsed: duration}
+		select {
+		case <-timer.C:
+			result.at = time.Now()
+		case <-m.Context().Done():
+			elapsed := time.Since(start).Round(time.Millisecond)
+			result = slowResult{Status: "interrupted", Reason: m.Reason(), Duration: elapsed.String(), elapsed: elapsed}
+			slog.Info("Slow WebSocket request interrupted", "id", m.d.connID(), "reason", result.Reason, "elapsed", elapsed)
+		}
+
+		if err := m.Reply(result); err != nil {
+			return err
+		}
+		if result.Status == "completed" {
+			slog.Info("Slow WebSocket operation completed", "id", m.d.connID())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,378 @@
+// Package router dispatches WebSocket messages to application handlers.
+// Text messages are routed by prefix, JSON envelopes such as
+// {"type":"echo","payload":"hi"} by their type field. Handlers reply in the
+// format the message came in. On json.v1 connections every message is an
+// envelope, see package protocol.
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+	"github.com/ArditZubaku/go-node-ws/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Handler handles one message. It returns an error only when the
+// connection can no longer be written to, which closes it; failures the
+// client should hear about are reported with Message.Error.
+type Handler func(m *Message) error
+
+// SendFunc writes the frame encode builds to the client. encode is given
+// the sequence number the reply is sent under, json.v1 replies carry it.
+type SendFunc func(messageType int, encode func(seq uint64) ([]byte, error)) error
+
+const (
+	// CodeUnknownType is the error code of messages no handler is
+	// registered for
+	CodeUnknownType = "unknown_type"
+	// CodeInvalidMessage is the error code of json.v1 messages that are not
+	// a valid envelope
+	CodeInvalidMessage = "invalid_message"
+)
+
+type prefixRoute struct {
+	prefix  string
+	handler Handler
+}
+
+// Router holds the registered handlers. Register every handler before the
+// first message is dispatched.
+type Router struct {
+	cm       *connmanager.ConnectionManager
+	prefixes []prefixRoute
+	types    map[string]Handler
+}
+
+func New(cm *connmanager.ConnectionManager) *Router {
+	return &Router{cm: cm, types: make(map[string]Handler)}
+}
+
+// HandlePrefix routes text messages starting with prefix to h. The longest
+// matching prefix wins, so the empty prefix catches every other message.
+func (rt *Router) HandlePrefix(prefix string, h Handler) {
+	rt.prefixes = append(rt.prefixes, prefixRoute{prefix, h})
+	sort.SliceStable(rt.prefixes, func(i, j int) bool {
+		return len(rt.prefixes[i].prefix) > len(rt.prefixes[j].prefix)
+	})
+}
+
+// HandleType routes JSON envelopes with the given type to h
+func (rt *Router) HandleType(typ string, h Handler) {
+	rt.types[typ] = h
+}
+
+// parseEnvelope returns the envelope data holds, if it is a JSON object
+// with a type
+func parseEnvelope(data []byte) (protocol.Request, bool) {
+	var req protocol.Request
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return req, false
+	}
+	if err := json.Unmarshal(data, &req); err != nil || req.Type == "" {
+		return req, false
+	}
+	return req, true
+}
+
+// reject answers a message with an error instead of handling it
+func reject(code, message string) Handler {
+	return func(m *Message) error {
+		return m.Error(code, message)
+	}
+}
+
+// route finds the handler of a message and fills in its route and payload.
+// A nil handler means there is nothing to answer, as for acks.
+func (d *Dispatcher) route(m *Message) (Handler, string) {
+	if d.proto == protocol.JSON {
+		return d.routeJSON(m)
+	}
+	if m.Frame == websocket.TextMessage {
+		// "ACK <seq>" acknowledges every message up to seq
+		if ack, ok := strings.CutPrefix(string(m.Data), "ACK "); ok {
+			if seq, err := strconv.ParseUint(ack, 10, 64); err == nil {
+				d.ack(seq)
+				return nil, "ack"
+			}
+		}
+		if req, ok := parseEnvelope(m.Data); ok {
+			return d.routeType(m, req)
+		}
+	}
+	for _, r := range d.rt.prefixes {
+		if bytes.HasPrefix(m.Data, []byte(r.prefix)) {
+			m.Type = r.prefix
+			m.Payload = bytes.TrimSpace(m.Data[len(r.prefix):])
+			return r.handler, "prefix:" + r.prefix
+		}
+	}
+	return reject(CodeUnknownType, "no handler for message"), "unknown"
+}
+
+// routeJSON routes a message on a json.v1 connection, which has to be an
+// envelope
+func (d *Dispatcher) routeJSON(m *Message) (Handler, string) {
+	m.json = true
+	if m.Frame != websocket.TextMessage {
+		return reject(CodeInvalidMessage, "binary messages are not supported"), "invalid"
+	}
+	var req protocol.Request
+	if err := json.Unmarshal(m.Data, &req); err != nil {
+		return reject(CodeInvalidMessage, "message is not a JSON envelope"), "invalid"
+	}
+	switch {
+	case req.Type != "":
+		return d.routeType(m, req)
+	case req.Ack != nil:
+		d.ack(*req.Ack)
+		return nil, "ack"
+	}
+	m.ID = req.ID
+	return reject(CodeInvalidMessage, "type is required"), "invalid"
+}
+
+// routeType routes an envelope by its type, after recording its ack
+func (d *Dispatcher) routeType(m *Message, req protocol.Request) (Handler, string) {
+	if req.Ack != nil {
+		d.ack(*req.Ack)
+	}
+	m.json = true
+	m.ID, m.Type, m.Payload = req.ID, req.Type, req.Payload
+	if h, ok := d.rt.types[req.Type]; ok {
+		return h, "type:" + req.Type
+	}
+	return reject(CodeUnknownType, fmt.Sprintf("no handler for type %q", req.Type)), "unknown"
+}
+
+// Interrupted is the cause of a cancelled message context
+type Interrupted struct {
+	Reason string
+}
+
+func (e *Interrupted) Error() string {
+	return "interrupted by " + e.Reason
+}
+
+// Dispatcher routes the messages of one connection, one at a time in the
+// order they arrive
+type Dispatcher struct {
+	rt     *Router
+	conn   *connmanager.Connection
+	proto  string
+	send   SendFunc
+	onAck  func(seq uint64)
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// NewDispatcher returns a dispatcher for conn whose replies go through send.
+// It speaks the protocol conn negotiated, text.v1 without a conn. The
+// message contexts derive from ctx and are cancelled when the server shuts
+// down or the dispatcher is closed.
+func (rt *Router) NewDispatcher(ctx context.Context, conn *connmanager.Connection, send SendFunc) *Dispatcher {
+	ctx, cancel := context.WithCancelCause(ctx)
+	d := &Dispatcher{rt: rt, conn: conn, proto: protocol.Text, send: send, ctx: ctx, cancel: cancel}
+	if conn != nil {
+		d.proto = conn.Protocol
+	}
+	if rt.cm != nil {
+		go func() {
+			select {
+			case <-rt.cm.Shutdown:
+				cancel(&Interrupted{Reason: "server shutdown"})
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return d
+}
+
+// Close cancels the context of a running handler
+func (d *Dispatcher) Close() {
+	d.cancel(errors.New("connection closed"))
+}
+
+// HandleAck has fn called with the sequence numbers clients acknowledge,
+// with "ACK <seq>" or the ack field of an envelope
+func (d *Dispatcher) HandleAck(fn func(seq uint64)) {
+	d.onAck = fn
+}
+
+func (d *Dispatcher) ack(seq uint64) {
+	if d.onAck != nil {
+		d.onAck(seq)
+	}
+}
+
+// Dispatch runs the handler of a message. Messages without one get an
+// unknown_type error reply, invalid json.v1 envelopes an invalid_message
+// one.
+func (d *Dispatcher) Dispatch(frame int, data []byte) error {
+	ctx, cancel := context.WithCancelCause(d.ctx)
+	defer cancel(nil)
+	m := &Message{Frame: frame, Data: data, Conn: d.conn, ctx: ctx, cancel: cancel, d: d}
+	defer m.end()
+
+	h, route := d.route(m)
+	metrics.RoutedMessages.Inc(route)
+	if h == nil {
+		return nil
+	}
+	slog.Debug("Routing message", "id", d.connID(), "route", route)
+	return h(m)
+}
+
+func (d *Dispatcher) connID() string {
+	if d.conn == nil {
+		return ""
+	}
+	return d.conn.ID
+}
+
+// Message is a message being handled
+type Message struct {
+	// Frame is the WebSocket message type, text or binary
+	Frame int
+	// Data is the message as received
+	Data []byte
+	// ID is the id of a JSON envelope, sent back with every reply
+	ID json.RawMessage
+	// Type is the matched prefix or envelope type
+	Type string
+	// Payload is the text after the prefix, or the envelope payload
+	Payload []byte
+	Conn    *connmanager.Connection
+
+	json   bool
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	d      *Dispatcher
+	op     *connmanager.Operation
+}
+
+// Context is cancelled when the server shuts down and, after Begin, when a
+// drain or kick interrupts the work
+func (m *Message) Context() context.Context {
+	return m.ctx
+}
+
+// Reason explains why the context was cancelled, empty while it is not
+func (m *Message) Reason() string {
+	var interrupted *Interrupted
+	if errors.As(context.Cause(m.ctx), &interrupted) {
+		return interrupted.Reason
+	}
+	if err := context.Cause(m.ctx); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// Begin reports the handler as in-flight work named name until it returns.
+// Closes then treat the connection as busy, see connmanager.InFlightPolicy,
+// and an interruption cancels the context.
+func (m *Message) Begin(name string) {
+	if m.op != nil || m.Conn == nil || m.d.rt.cm == nil {
+		return
+	}
+	op := m.d.rt.cm.BeginOperation(m.Conn, name)
+	m.op = op
+	go func() {
+		select {
+		case <-op.Interrupted():
+			m.cancel(&Interrupted{Reason: op.Reason()})
+		case <-op.Done():
+		}
+	}()
+}
+
+// end finishes the in-flight work after the handler queued its last reply,
+// so a close waiting for it queues the close frame behind the reply
+func (m *Message) end() {
+	if m.op != nil {
+		m.op.End()
+	}
+}
+
+// Reply sends the answer to the message. Text messages get v as text:
+// strings and byte slices as they are, fmt.Stringers through String and
+// anything else as JSON. JSON envelopes get v as the reply payload.
+func (m *Message) Reply(v any) error {
+	return m.write(protocol.Envelope{Payload: v})
+}
+
+// Stream sends a partial answer, the handler replies again later. JSON
+// replies are marked with "stream":true.
+func (m *Message) Stream(v any) error {
+	return m.write(protocol.Envelope{Payload: v, Stream: true})
+}
+
+// Error reports a failure to the client, as "ERROR <code>: <message>" for
+// text messages and in the error field of a JSON reply
+func (m *Message) Error(code, message string) error {
+	return m.write(protocol.Envelope{Error: &protocol.Error{Code: code, Message: message}})
+}
+
+func (m *Message) write(r protocol.Envelope) error {
+	frame := m.Frame
+	if m.json {
+		frame = websocket.TextMessage
+	}
+	return m.d.send(frame, func(seq uint64) ([]byte, error) {
+		var data []byte
+		var err error
+		switch {
+		case m.json:
+			r.ID, r.Type, r.Seq = m.ID, m.Type, seq
+			if r.Type == "" {
+				r.Type = protocol.TypeError
+			}
+			data, err = json.Marshal(r)
+		case r.Error != nil:
+			data = []byte(fmt.Sprintf("ERROR %s: %s", r.Error.Code, r.Error.Message))
+		default:
+			data, err = text(r.Payload)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("encode reply: %w", err)
+		}
+		return data, nil
+	})
+}
+
+// text renders a reply payload for a text message
+func text(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case fmt.Stringer:
+		return []byte(v.String()), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// Routes lists the registered routes
+func (rt *Router) Routes() []string {
+	routes := make([]string, 0, len(rt.prefixes)+len(rt.types))
+	for _, r := range rt.prefixes {
+		routes = append(routes, "prefix:"+r.prefix)
+	}
+	for t := range rt.types {
+		routes = append(routes, "type:"+t)
+	}
+	sort.Strings(routes)
+	return routes
+}
@@ -0,0 +1,153 @@
+package router
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// recorder collects the replies of a dispatcher
+type recorder struct {
+	replies []string
+}
+
+func (r *recorder) send(_ int, encode func(seq uint64) ([]byte, error)) error {
+	data, err := encode(0)
+	if err != nil {
+		return err
+	}
+	r.replies = append(r.replies, string(data))
+	return nil
+}
+
+func dispatcher(t *testing.T, rt *Router) (*Dispatcher, *recorder) {
+	t.Helper()
+	rec := &recorder{}
+	d := rt.NewDispatcher(context.Background(), nil, rec.send)
+	t.Cleanup(d.Close)
+	return d, rec
+}
+
+func replyWith(name string) Handler {
+	return func(m *Message) error {
+		return m.Reply(name + ":" + string(m.Payload))
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	rt := New(nil)
+	rt.HandlePrefix("", replyWith("fallback"))
+	rt.HandlePrefix("SLOW", replyWith("slow"))
+	rt.HandlePrefix("SLOW_PING", replyWith("ping"))
+	rt.HandleType("echo", Echo)
+	d, rec := dispatcher(t, rt)
+
+	messages := map[string]string{
+		"hi":                                "fallback:hi",
+		"S":                                 "fallback:S",
+		"SLOW_REQUEST":                      "slow:_REQUEST",
+		"SLOW_PING 3":                       "ping:3",
+		`{"type":"echo","payload":{"n":1}}`: `{"type":"echo","payload":{"n":1}}`,
+		`{"type":"nope"}`:                   `{"type":"nope","error":{"code":"unknown_type","message":"no handler for type \"nope\""}}`,
+		`{"no":"type"}`:                     `fallback:{"no":"type"}`,
+		`{"type":"echo","payload":"broken"`: `fallback:{"type":"echo","payload":"broken"`,
+	}
+	for message, want := range messages {
+		rec.replies = nil
+		if err := d.Dispatch(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.replies) != 1 || rec.replies[0] != want {
+			t.Errorf("%s: replies %q, want %q", message, rec.replies, want)
+		}
+	}
+}
+
+func TestUnknownText(t *testing.T) {
+	rt := New(nil)
+	rt.HandlePrefix("PING", replyWith("ping"))
+	d, rec := dispatcher(t, rt)
+	if err := d.Dispatch(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ERROR unknown_type: no handler for message"; len(rec.replies) != 1 || rec.replies[0] != want {
+		t.Errorf("replies %q, want %q", rec.replies, want)
+	}
+}
+
+func TestStream(t *testing.T) {
+	rt := New(nil)
+	rt.HandleType("count", func(m *Message) error {
+		for i := range 2 {
+			if err := m.Stream(i); err != nil {
+				return err
+			}
+		}
+		return m.Reply("done")
+	})
+	d, rec := dispatcher(t, rt)
+	if err := d.Dispatch(websocket.TextMessage, []byte(`{"type":"count"}`)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`{"type":"count","payload":0,"stream":true}`,
+		`{"type":"count","payload":1,"stream":true}`,
+		`{"type":"count","payload":"done"}`,
+	}
+	if strings.Join(rec.replies, "\n") != strings.Join(want, "\n") {
+		t.Errorf("replies %q, want %q", rec.replies, want)
+	}
+}
+
+func TestSlowInterrupted(t *testing.T) {
+	rt := New(nil)
+	rt.HandlePrefix("SLOW_REQUEST", Slow(time.Minute))
+	rt.HandleType("slow_request", Slow(time.Minute))
+	for _, message := range []string{"SLOW_REQUEST", `{"type":"slow_request"}`} {
+		rec := &recorder{}
+		ctx, cancel := context.WithCancelCause(context.Background())
+		d := rt.NewDispatcher(ctx, nil, rec.send)
+		time.AfterFunc(10*time.Millisecond, func() { cancel(&Interrupted{Reason: "server drain"}) })
+		if err := d.Dispatch(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.replies) != 1 {
+			t.Fatalf("%s: replies %q", message, rec.replies)
+		}
+		got := rec.replies[0]
+		if !strings.Contains(got, "SLOW_INTERRUPTED: Request interrupted by server drain after") &&
+			!strings.Contains(got, `"status":"interrupted","reason":"server drain"`) {
+			t.Errorf("%s: reply %q, want an interruption by server drain", message, got)
+		}
+	}
+}
+
+func TestAck(t *testing.T) {
+	var acked []uint64
+	for _, proto := range []string{protocol.Text, protocol.JSON} {
+		rt := New(nil)
+		rt.HandlePrefix("", Echo)
+		rec := &recorder{}
+		d := rt.NewDispatcher(context.Background(), &connmanager.Connection{Protocol: proto}, rec.send)
+		d.HandleAck(func(seq uint64) { acked = append(acked, seq) })
+		message := "ACK 4"
+		if proto == protocol.JSON {
+			message = `{"ack":5}`
+		}
+		if err := d.Dispatch(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.replies) != 0 {
+			t.Errorf("%s: ack answered with %q", proto, rec.replies)
+		}
+		d.Close()
+	}
+	if len(acked) != 2 || acked[0] != 4 || acked[1] != 5 {
+		t.Errorf("acked %v, want [4 5]", acked)
+	}
+}
@@ -0,0 +1,209 @@
+// Package session keeps per-client resumption state, so a client whose
+// connection is drained can reconnect, possibly to another server process,
+// and get the messages it missed replayed.
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Message is an outbound message the client has not acknowledged yet
+type Message struct {
+	Seq  uint64 `json:"seq"`
+	Type int    `json:"type"`
+	Data []byte `json:"data"`
+}
+
+// State is the persisted form of a session
+type State struct {
+	Token string `json:"token"`
+	// LastSeq is the sequence number of the last message sent
+	LastSeq uint64 `json:"last_seq"`
+	// Acked is the highest sequence number the client acknowledged
+	Acked     uint64    `json:"acked"`
+	Pending   []Message `json:"pending"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Session is the live resumption state of a connected client
+type Session struct {
+	mu    sync.Mutex
+	state State
+	limit int
+}
+
+func (s *Session) Token() string {
+	return s.state.Token
+}
+
+// Record buffers an outbound message and returns its sequence number. When
+// the buffer is full the oldest message is dropped.
+func (s *Session) Record(messageType int, data []byte) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(messageType, data)
+	return s.state.LastSeq
+}
+
+// RecordWith buffers the message encode builds from its sequence number,
+// for messages that carry their own, and returns it
+func (s *Session) RecordWith(messageType int, encode func(seq uint64) ([]byte, error)) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := encode(s.state.LastSeq + 1)
+	if err != nil {
+		return nil, err
+	}
+	s.record(messageType, data)
+	return data, nil
+}
+
+func (s *Session) record(messageType int, data []byte) {
+	s.state.LastSeq++
+	s.state.Pending = append(s.state.Pending, Message{
+		Seq:  s.state.LastSeq,
+		Type: messageType,
+		Data: slices.Clone(data),
+	})
+	if over := len(s.state.Pending) - s.limit; over > 0 {
+		s.state.Pending = slices.Delete(s.state.Pending, 0, over)
+	}
+}
+
+// Ack drops every buffered message up to and including seq
+func (s *Session) Ack(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ackLocked(seq)
+}
+
+func (s *Session) ackLocked(seq uint64) {
+	seq = min(seq, s.state.LastSeq)
+	if seq <= s.state.Acked {
+		return
+	}
+	s.state.Acked = seq
+	s.state.Pending = slices.DeleteFunc(s.state.Pending, func(m Message) bool {
+		return m.Seq <= seq
+	})
+}
+
+// Since acknowledges everything up to seq and returns the buffered messages
+// after it, oldest first
+func (s *Session) Since(seq uint64) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ackLocked(seq)
+	return slices.Clone(s.state.Pending)
+}
+
+// NextSeq returns the sequence number the next replayed or new message
+// will carry
+func (s *Session) NextSeq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.state.Pending) > 0 {
+		return s.state.Pending[0].Seq
+	}
+	return s.state.LastSeq + 1
+}
+
+// Acked returns the highest sequence number the client acknowledged
+func (s *Session) Acked() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Acked
+}
+
+func (s *Session) snapshot() *State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	state.Pending = slices.Clone(s.state.Pending)
+	state.UpdatedAt = time.Now()
+	return &state
+}
+
+// Manager opens and suspends sessions against a Store
+type Manager struct {
+	store      Store
+	bufferSize int
+}
+
+// NewManager returns a Manager keeping up to bufferSize unacknowledged
+// messages per session
+func NewManager(store Store, bufferSize int) *Manager {
+	return &Manager{store: store, bufferSize: max(bufferSize, 1)}
+}
+
+// Open resumes the session for token, or starts a new one when token is
+// empty, unknown or expired. The session is removed from the store while
+// it is open, so a token can only be resumed by one connection at a time.
+func (m *Manager) Open(token string) (s *Session, resumed bool) {
+	if token != "" && ValidToken(token) {
+		state, err := m.store.Load(token)
+		switch {
+		case err == nil:
+			if err := m.store.Delete(token); err != nil {
+				slog.Error("Failed to claim session", "token", token, "error", err)
+			}
+			return &Session{state: *state, limit: m.bufferSize}, true
+		case err != ErrNotFound:
+			slog.Error("Failed to load session", "token", token, "error", err)
+		}
+	}
+	return &Session{state: State{Token: newToken()}, limit: m.bufferSize}, false
+}
+
+// Suspend persists s so the client can resume it after reconnecting
+func (m *Manager) Suspend(s *Session) {
+	if err := m.store.Save(s.snapshot()); err != nil {
+		slog.Error("Failed to save session", "token", s.Token(), "error", err)
+	}
+}
+
+// SweepExpired removes expired sessions from the store every interval until
+// stop is closed
+func (m *Manager) SweepExpired(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			removed, err := m.store.Sweep()
+			if err != nil {
+				slog.Error("Failed to sweep expired sessions", "error", err)
+			}
+			if removed > 0 {
+				slog.Debug("Expired sessions removed", "count", removed)
+			}
+		}
+	}
+}
+
+const tokenBytes = 16
+
+func newToken() string {
+	b := make([]byte, tokenBytes)
+	// crypto/rand.Read never returns an error
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidToken reports whether token has the shape of an issued token. Stores
+// may use tokens as file names, so anything else is rejected.
+func ValidToken(token string) bool {
+	if len(token) != 2*tokenBytes {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
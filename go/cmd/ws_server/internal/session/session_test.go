@@ -0,0 +1,236 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func stores(t *testing.T, ttl time.Duration) map[string]Store {
+	t.Helper()
+	file, err := NewFileStore(t.TempDir(), ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{"memory": NewMemoryStore(ttl), "file": file}
+}
+
+func record(s *Session, messages ...string) {
+	for _, m := range messages {
+		s.Record(websocket.TextMessage, []byte(m))
+	}
+}
+
+func data(messages []Message) []string {
+	var out []string
+	for _, m := range messages {
+		out = append(out, string(m.Data))
+	}
+	return out
+}
+
+func TestStoreSaveLoad(t *testing.T) {
+	for name, store := range stores(t, time.Minute) {
+		state := &State{
+			Token:     newToken(),
+			LastSeq:   2,
+			Acked:     1,
+			Pending:   []Message{{Seq: 2, Type: websocket.TextMessage, Data: []byte("b")}},
+			UpdatedAt: time.Now(),
+		}
+		if err := store.Save(state); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := store.Load(state.Token)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got.LastSeq != 2 || got.Acked != 1 || !slices.Equal(data(got.Pending), []string{"b"}) {
+			t.Errorf("%s: loaded %+v", name, got)
+		}
+
+		if err := store.Delete(state.Token); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := store.Load(state.Token); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: Load after Delete: %v, want ErrNotFound", name, err)
+		}
+		if _, err := store.Load(newToken()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: Load of an unknown token: %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	for name, store := range stores(t, time.Minute) {
+		old := &State{Token: newToken(), UpdatedAt: time.Now().Add(-2 * time.Minute)}
+		if err := store.Save(old); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Load(old.Token); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: Load of an expired session: %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestStoreSweep(t *testing.T) {
+	for name, store := range stores(t, time.Minute) {
+		fresh := &State{Token: newToken(), UpdatedAt: time.Now()}
+		old := &State{Token: newToken(), UpdatedAt: time.Now().Add(-2 * time.Minute)}
+		for _, state := range []*State{fresh, old} {
+			if err := store.Save(state); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if file, ok := store.(*FileStore); ok {
+			// The file store goes by the time the file was written
+			past := time.Now().Add(-2 * time.Minute)
+			path, _ := file.path(old.Token)
+			os.Chtimes(path, past, past)
+			leftover := filepath.Join(file.dir, old.Token+".123.tmp")
+			os.WriteFile(leftover, nil, 0o600)
+			os.Chtimes(leftover, past, past)
+		}
+
+		removed, err := store.Sweep()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := 1
+		if _, ok := store.(*FileStore); ok {
+			want = 2
+		}
+		if removed != want {
+			t.Errorf("%s: swept %d, want %d", name, removed, want)
+		}
+		if _, err := store.Load(fresh.Token); err != nil {
+			t.Errorf("%s: fresh session swept: %v", name, err)
+		}
+	}
+}
+
+func TestFileStoreRejectsInvalidTokens(t *testing.T) {
+	store, err := NewFileStore(t.TempDir(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"", "../../etc/passwd", "not-hex-not-hex-not-hex-not-hex!"} {
+		if err := store.Save(&State{Token: token}); err == nil {
+			t.Errorf("Save with token %q did not fail", token)
+		}
+	}
+}
+
+func TestResumeReplaysAfterLast(t *testing.T) {
+	for name, store := range stores(t, time.Minute) {
+		m := NewManager(store, 3)
+		s, resumed := m.Open("")
+		if resumed || s.NextSeq() != 1 {
+			t.Fatalf("%s: new session resumed=%v next=%d", name, resumed, s.NextSeq())
+		}
+		record(s, "a", "b", "c", "d")
+		s.Ack(1)
+		m.Suspend(s)
+
+		// The buffer of 3 dropped a, the client saw b
+		resumedSession, resumed := m.Open(s.Token())
+		if !resumed {
+			t.Fatalf("%s: session not resumed", name)
+		}
+		if got := data(resumedSession.Since(2)); !slices.Equal(got, []string{"c", "d"}) {
+			t.Errorf("%s: replay after 2 = %q, want [c d]", name, got)
+		}
+		if resumedSession.Acked() != 2 || resumedSession.NextSeq() != 3 {
+			t.Errorf("%s: acked %d next %d after resuming", name, resumedSession.Acked(), resumedSession.NextSeq())
+		}
+		if seq := resumedSession.Record(websocket.TextMessage, []byte("e")); seq != 5 {
+			t.Errorf("%s: next message numbered %d, want 5", name, seq)
+		}
+
+		// An open session cannot be resumed a second time
+		if _, resumed := m.Open(s.Token()); resumed {
+			t.Errorf("%s: open session resumed twice", name)
+		}
+	}
+}
+
+func TestFileStoreSharedByTwoManagers(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Manager {
+		store, err := NewFileStore(dir, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewManager(store, 16)
+	}
+	first, second := open(), open()
+
+	s, _ := first.Open("")
+	record(s, "a", "b", "c")
+	first.Suspend(s)
+
+	resumed, ok := second.Open(s.Token())
+	if !ok {
+		t.Fatal("session not resumed by the second manager")
+	}
+	if got := data(resumed.Since(1)); !slices.Equal(got, []string{"b", "c"}) {
+		t.Errorf("replay after 1 = %q, want [b c]", got)
+	}
+	if _, ok := first.Open(s.Token()); ok {
+		t.Error("session claimed by the second manager resumed by the first")
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	store := NewMemoryStore(time.Minute)
+	store.Save(&State{Token: newToken(), UpdatedAt: time.Now().Add(-2 * time.Minute)})
+	m := NewManager(store, 16)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.SweepExpired(time.Millisecond, stop)
+		close(done)
+	}()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		store.mu.Lock()
+		n := len(store.sessions)
+		store.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired session not swept")
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func TestRecordWith(t *testing.T) {
+	m := NewManager(NewMemoryStore(time.Minute), 16)
+	s, _ := m.Open("")
+	record(s, "a")
+	b, err := s.RecordWith(websocket.TextMessage, func(seq uint64) ([]byte, error) {
+		return fmt.Appendf(nil, "b%d", seq), nil
+	})
+	if err != nil || string(b) != "b2" {
+		t.Fatalf("RecordWith = %q, %v", b, err)
+	}
+	if _, err := s.RecordWith(websocket.TextMessage, func(uint64) ([]byte, error) { return nil, errors.New("encode") }); err == nil {
+		t.Error("encoding error not returned")
+	}
+	// A failed encoding uses up no number
+	if got := data(s.Since(0)); !slices.Equal(got, []string{"a", "b2"}) || s.NextSeq() != 1 {
+		t.Errorf("buffered %q", got)
+	}
+	if seq := s.Record(websocket.TextMessage, []byte("c")); seq != 3 {
+		t.Errorf("next message numbered %d, want 3", seq)
+	}
+}
@@ -0,0 +1,206 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Store.Load for unknown or expired sessions
+var ErrNotFound = errors.New("session not found")
+
+// Store persists suspended sessions between connections
+type Store interface {
+	Load(token string) (*State, error)
+	Save(state *State) error
+	Delete(token string) error
+	// Sweep removes the expired sessions and returns how many it removed
+	Sweep() (int, error)
+}
+
+// StoreByName builds the store selected by SESSION_STORE. dir is only used
+// by the file store.
+func StoreByName(name, dir string, ttl time.Duration) (Store, error) {
+	switch name {
+	case "memory":
+		return NewMemoryStore(ttl), nil
+	case "file":
+		return NewFileStore(dir, ttl)
+	default:
+		return nil, fmt.Errorf("unknown session store %q (available: memory, file)", name)
+	}
+}
+
+// MemoryStore keeps sessions in process memory. Sessions only survive
+// reconnects to the same process.
+type MemoryStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*State
+}
+
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{ttl: ttl, sessions: make(map[string]*State)}
+}
+
+func (s *MemoryStore) Load(token string) (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.sessions[token]
+	if !ok || expired(state, s.ttl) {
+		delete(s.sessions, token)
+		return nil, ErrNotFound
+	}
+	return state, nil
+}
+
+func (s *MemoryStore) Save(state *State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[state.Token] = state
+	return nil
+}
+
+func (s *MemoryStore) Delete(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+	return nil
+}
+
+func (s *MemoryStore) Sweep() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for token, state := range s.sessions {
+		if expired(state, s.ttl) {
+			delete(s.sessions, token)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// FileStore keeps one JSON file per session in a directory. Server
+// processes sharing the directory can resume each other's sessions.
+type FileStore struct {
+	dir string
+	ttl time.Duration
+}
+
+func NewFileStore(dir string, ttl time.Duration) (*FileStore, error) {
+	if dir == "" {
+		return nil, errors.New("file session store needs a directory")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create session directory: %w", err)
+	}
+	return &FileStore{dir: dir, ttl: ttl}, nil
+}
+
+func (s *FileStore) path(token string) (string, error) {
+	if !ValidToken(token) {
+		return "", fmt.Errorf("invalid session token %q", token)
+	}
+	return filepath.Join(s.dir, token+".json"), nil
+}
+
+func (s *FileStore) Load(token string) (*State, error) {
+	path, err := s.path(token)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("decode session %s: %w", token, err)
+	}
+	if expired(&state, s.ttl) {
+		_ = os.Remove(path)
+		return nil, ErrNotFound
+	}
+	return &state, nil
+}
+
+// Save writes state to a temporary file and renames it into place, so a
+// concurrent Load never sees a partial file
+func (s *FileStore) Save(state *State) error {
+	path, err := s.path(state.Token)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, state.Token+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileStore) Delete(token string) error {
+	path, err := s.path(token)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Sweep removes the session files, and the temporary files of interrupted
+// saves, not written to within the TTL. The modification time of a file is
+// when it was saved, so the files do not need to be decoded.
+func (s *FileStore) Sweep() (int, error) {
+	if s.ttl <= 0 {
+		return 0, nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || (filepath.Ext(name) != ".json" && filepath.Ext(name) != ".tmp") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) <= s.ttl {
+			continue
+		}
+		// Another process sharing the directory may have swept it already
+		if err := os.Remove(filepath.Join(s.dir, name)); err == nil {
+			removed++
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func expired(state *State, ttl time.Duration) bool {
+	return ttl > 0 && time.Since(state.UpdatedAt) > ttl
+}
@@ -0,0 +1,419 @@
+// Package shutdown orchestrates the graceful shutdown of the ws_server as an
+// explicit sequence of phases, each with its own timeout and hooks.
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+)
+
+// Phase is a step of the shutdown sequence
+type Phase string
+
+const (
+	PhaseRunning       Phase = "running"
+	PhaseNotReady      Phase = "not-ready"
+	PhaseDeregister    Phase = "deregister"
+	PhaseStopAccepting Phase = "stop-accepting"
+	PhaseDrain         Phase = "drain"
+	PhaseInFlightGrace Phase = "in-flight-grace"
+	PhaseCloseFrames   Phase = "close-frames"
+	PhaseForceClose    Phase = "force-close"
+	PhaseStopped       Phase = "stopped"
+)
+
+// Config holds the timeout of each phase. A zero duration skips the waiting
+// part of that phase, hooks still run.
+type Config struct {
+	// DeregisterDelay is how long to keep serving while reporting not-ready
+	DeregisterDelay time.Duration
+	// StopAcceptingTimeout bounds the hooks that close the listeners
+	StopAcceptingTimeout time.Duration
+	// DrainDuration spreads the progressive drain of remaining connections
+	DrainDuration time.Duration
+	// InFlightGrace is how long in-flight operations may keep running
+	InFlightGrace time.Duration
+	// CloseTimeout is how long clients get to answer close frames
+	CloseTimeout time.Duration
+	// UpgradeDrainDuration replaces DrainDuration when the shutdown follows
+	// an upgrade, the new process takes the reconnects
+	UpgradeDrainDuration time.Duration
+}
+
+// DefaultConfig matches the timeouts the server used before phases existed
+func DefaultConfig() Config {
+	return Config{
+		StopAcceptingTimeout: 30 * time.Second,
+		CloseTimeout:         5 * time.Second,
+		UpgradeDrainDuration: 30 * time.Second,
+	}
+}
+
+var (
+	ErrUpgradeUnsupported = errors.New("upgrades are not enabled")
+	ErrUpgradeInProgress  = errors.New("an upgrade is already in progress")
+	ErrShuttingDown       = errors.New("server is shutting down")
+)
+
+// Handoff passes the listeners to a new process and returns its PID, see
+// upgrade.Upgrader
+type Handoff func() (int, error)
+
+// Hook runs when the orchestrator enters a phase. ctx expires with the
+// phase timeout or when shutdown is forced.
+type Hook func(ctx context.Context, phase Phase)
+
+// Transition records when a phase started and how long it lasted
+type Transition struct {
+	Phase    Phase     `json:"phase"`
+	At       time.Time `json:"at"`
+	Duration string    `json:"duration,omitempty"`
+}
+
+// Status is a snapshot of the shutdown progress
+type Status struct {
+	Phase       Phase        `json:"phase"`
+	Transitions []Transition `json:"transitions,omitempty"`
+}
+
+// Orchestrator drives the shutdown phases
+type Orchestrator struct {
+	cm     *connmanager.ConnectionManager
+	engine *drain.Engine
+	cfg    Config
+
+	mu          sync.Mutex
+	phase       Phase
+	transitions []Transition
+	hooks       map[Phase][]Hook
+	handoff     Handoff
+	upgrading   bool
+
+	once   sync.Once
+	force  context.CancelFunc
+	forced context.Context
+	done   chan struct{}
+}
+
+func NewOrchestrator(cm *connmanager.ConnectionManager, engine *drain.Engine, cfg Config) *Orchestrator {
+	forced, force := context.WithCancel(context.Background())
+	return &Orchestrator{
+		cm:     cm,
+		engine: engine,
+		cfg:    cfg,
+		phase:  PhaseRunning,
+		hooks:  make(map[Phase][]Hook),
+		forced: forced,
+		force:  force,
+		done:   make(chan struct{}),
+	}
+}
+
+// OnPhase registers a hook to run when the orchestrator enters phase
+func (o *Orchestrator) OnPhase(phase Phase, hook Hook) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.hooks[phase] = append(o.hooks[phase], hook)
+}
+
+func (o *Orchestrator) Phase() Phase {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.phase
+}
+
+func (o *Orchestrator) Status() Status {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	status := Status{Phase: o.phase, Transitions: make([]Transition, len(o.transitions))}
+	copy(status.Transitions, o.transitions)
+	if n := len(status.Transitions); n > 0 && status.Transitions[n-1].Duration == "" && o.phase != PhaseStopped {
+		status.Transitions[n-1].Duration = time.Since(status.Transitions[n-1].At).Round(time.Millisecond).String()
+	}
+	return status
+}
+
+// Done is closed once the shutdown sequence has finished
+func (o *Orchestrator) Done() <-chan struct{} {
+	return o.done
+}
+
+// HandleSignals starts the shutdown on the first SIGINT or SIGTERM and
+// forces it on the second one. SIGUSR2 starts an upgrade.
+func (o *Orchestrator) HandleSignals() {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+
+	triggered := false
+	for {
+		select {
+		case s := <-sig:
+			switch {
+			case s == syscall.SIGUSR2:
+				slog.Info("Upgrade signal received")
+				go func() {
+					if _, err := o.Upgrade(); err != nil {
+						slog.Error("Upgrade failed", "error", err)
+					}
+				}()
+			case !triggered:
+				triggered = true
+				slog.Info("Shutdown signal received, starting graceful shutdown...")
+				o.Trigger()
+			default:
+				slog.Warn("Second shutdown signal received, forcing shutdown")
+				o.Force()
+				return
+			}
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// SetHandoff enables upgrades through handoff
+func (o *Orchestrator) SetHandoff(handoff Handoff) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.handoff = handoff
+}
+
+// Upgrade hands the listeners to a new process and, once it is ready, shuts
+// this one down. The deregister delay is skipped since the sockets stay
+// open, and the remaining connections are drained over UpgradeDrainDuration.
+// It returns the PID of the new process.
+func (o *Orchestrator) Upgrade() (int, error) {
+	o.mu.Lock()
+	handoff := o.handoff
+	switch {
+	case handoff == nil:
+		o.mu.Unlock()
+		return 0, ErrUpgradeUnsupported
+	case o.upgrading:
+		o.mu.Unlock()
+		return 0, ErrUpgradeInProgress
+	case o.phase != PhaseRunning:
+		o.mu.Unlock()
+		return 0, ErrShuttingDown
+	}
+	// Set before the handoff, the servers return as soon as their listeners
+	// are closed and main triggers the shutdown itself
+	o.upgrading = true
+	o.mu.Unlock()
+
+	pid, err := handoff()
+	if err != nil {
+		o.mu.Lock()
+		o.upgrading = false
+		o.mu.Unlock()
+		return 0, err
+	}
+	slog.Info("Listeners handed over, shutting down", "pid", pid)
+	o.Trigger()
+	return pid, nil
+}
+
+// Trigger starts the shutdown sequence in the background. Only the first
+// call has an effect.
+func (o *Orchestrator) Trigger() {
+	o.once.Do(func() {
+		go o.run()
+	})
+}
+
+// Force skips the remaining waits and closes all connections immediately
+func (o *Orchestrator) Force() {
+	o.force()
+}
+
+func (o *Orchestrator) run() {
+	defer close(o.done)
+
+	o.mu.Lock()
+	deregisterDelay, drainDuration := o.cfg.DeregisterDelay, o.cfg.DrainDuration
+	if o.upgrading {
+		deregisterDelay, drainDuration = 0, o.cfg.UpgradeDrainDuration
+	}
+	o.mu.Unlock()
+
+	o.enter(PhaseNotReady, 0, func(ctx context.Context) {
+		o.cm.MarkShuttingDown()
+	})
+
+	o.enter(PhaseDeregister, deregisterDelay, func(ctx context.Context) {
+		if deregisterDelay > 0 {
+			<-ctx.Done()
+		}
+	})
+
+	o.enter(PhaseStopAccepting, o.cfg.StopAcceptingTimeout, nil)
+
+	o.enter(PhaseDrain, drainDuration, func(ctx context.Context) {
+		o.drain(ctx, drainDuration)
+	})
+
+	o.enter(PhaseInFlightGrace, o.cfg.InFlightGrace, o.settleInFlight)
+
+	o.enter(PhaseCloseFrames, o.cfg.CloseTimeout, func(ctx context.Context) {
+		o.cm.CloseAllConnections(ctx)
+	})
+
+	// Force close ignores o.forced, it is the last resort
+	o.enter(PhaseForceClose, 0, func(ctx context.Context) {
+		o.cm.ForceCloseAll()
+	})
+
+	o.enter(PhaseStopped, 0, nil)
+}
+
+// enter switches to phase, runs its hooks and then its action, both bounded
+// by timeout. A zero timeout only bounds them by a forced shutdown.
+func (o *Orchestrator) enter(phase Phase, timeout time.Duration, action func(ctx context.Context)) {
+	o.mu.Lock()
+	now := time.Now()
+	if n := len(o.transitions); n > 0 {
+		last := &o.transitions[n-1]
+		elapsed := now.Sub(last.At)
+		last.Duration = elapsed.Round(time.Millisecond).String()
+		metrics.ShutdownPhaseDuration.Set(elapsed.Seconds(), string(last.Phase))
+	}
+	o.transitions = append(o.transitions, Transition{Phase: phase, At: now})
+	prev := o.phase
+	o.phase = phase
+	hooks := append([]Hook(nil), o.hooks[phase]...)
+	o.mu.Unlock()
+
+	slog.Info("Shutdown phase changed", "from", prev, "to", phase, "timeout", timeout)
+	o.cm.Publish(connmanager.Event{
+		Type:          connmanager.EventShutdownPhase,
+		Phase:         string(phase),
+		PreviousPhase: string(prev),
+		Remaining:     o.cm.GetConnectionsCount(),
+	})
+
+	parent := o.forced
+	if phase == PhaseForceClose || phase == PhaseStopped {
+		parent = context.Background()
+	}
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	defer cancel()
+
+	for _, hook := range hooks {
+		hook(ctx, phase)
+	}
+	if action != nil {
+		action(ctx)
+	}
+}
+
+// drain spreads the remaining closes over the phase, or waits for a drain an
+// operator already started. The shutdown drain only closes connections
+// without running operations, the busy ones are left to the in-flight grace
+// phase, so it ends once every remaining connection is busy.
+func (o *Orchestrator) drain(ctx context.Context, duration time.Duration) {
+	if duration <= 0 {
+		return
+	}
+
+	started := false
+	if !o.engine.Active() {
+		err := o.engine.Start(drain.Plan{
+			Mode:     drain.ModeSpread,
+			Duration: duration,
+			Interval: time.Second,
+			Strategy: skipBusy(o.cm.DefaultStrategy()),
+		})
+		if err != nil {
+			slog.Error("Failed to start shutdown drain", "error", err)
+		}
+		started = err == nil
+	}
+
+	o.waitFor(ctx, func() bool {
+		return !o.engine.Active() || (started && o.allBusy())
+	})
+	if o.engine.Active() {
+		if ctx.Err() != nil {
+			slog.Warn("Shutdown drain did not finish in time, cancelling it")
+		} else {
+			slog.Info("No idle connections left, ending the shutdown drain")
+		}
+		o.engine.Cancel()
+	}
+}
+
+// allBusy reports whether every remaining connection runs an operation
+func (o *Orchestrator) allBusy() bool {
+	for _, c := range o.cm.Connections() {
+		if c.InFlight() == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// skipBusy wraps s so it never selects connections with running operations
+func skipBusy(s connmanager.Strategy) connmanager.Strategy {
+	return connmanager.NewStrategyFunc(s.Name(), func(connections []*connmanager.Connection, n int) []*connmanager.Connection {
+		idle := slices.DeleteFunc(slices.Clone(connections), func(c *connmanager.Connection) bool {
+			return c.InFlight() > 0
+		})
+		return s.Select(idle, n)
+	})
+}
+
+// settleInFlight applies the manager's in-flight policy to the operations
+// still running: they either get the grace period to finish or are
+// interrupted right away and get it to report the interruption
+func (o *Orchestrator) settleInFlight(ctx context.Context) {
+	if o.cfg.InFlightGrace <= 0 {
+		return
+	}
+	count := o.cm.InFlightCount()
+	if count == 0 {
+		return
+	}
+
+	policy := o.cm.CloseOptions().Policy
+	slog.Info("Settling in-flight operations", "count", count, "policy", policy)
+	if policy == connmanager.PolicyInterrupt {
+		o.cm.InterruptAll("server shutdown")
+	}
+	o.waitFor(ctx, func() bool { return o.cm.InFlightCount() == 0 })
+	if remaining := o.cm.InFlightCount(); remaining > 0 {
+		slog.Warn("In-flight operations still running after grace period", "count", remaining)
+	}
+}
+
+// waitFor polls cond until it holds or ctx expires
+func (o *Orchestrator) waitFor(ctx context.Context, cond func() bool) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
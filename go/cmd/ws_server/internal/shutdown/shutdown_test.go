@@ -0,0 +1,184 @@
+package shutdown
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+	"github.com/gorilla/websocket"
+)
+
+var allPhases = []Phase{
+	PhaseNotReady,
+	PhaseDeregister,
+	PhaseStopAccepting,
+	PhaseDrain,
+	PhaseInFlightGrace,
+	PhaseCloseFrames,
+	PhaseForceClose,
+	PhaseStopped,
+}
+
+// connect opens n WebSocket connections tracked by cm and returns their
+// server side records
+func connect(t *testing.T, cm *connmanager.ConnectionManager, n int) []*connmanager.Connection {
+	t.Helper()
+	added := make(chan *connmanager.Connection)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := cm.AddConnection(conn, r)
+		added <- c
+		defer cm.RemoveConnection(c)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	var connections []*connmanager.Connection
+	for range n {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		// Answer close frames like a browser would
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		connections = append(connections, <-added)
+	}
+	return connections
+}
+
+// record registers a hook on every phase and returns the phases entered
+func record(o *Orchestrator) func() []Phase {
+	var (
+		mu      sync.Mutex
+		entered []Phase
+	)
+	for _, phase := range allPhases {
+		o.OnPhase(phase, func(ctx context.Context, phase Phase) {
+			mu.Lock()
+			defer mu.Unlock()
+			entered = append(entered, phase)
+		})
+	}
+	return func() []Phase {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(entered)
+	}
+}
+
+func wait(t *testing.T, o *Orchestrator, timeout time.Duration) {
+	t.Helper()
+	select {
+	case <-o.Done():
+	case <-time.After(timeout):
+		t.Fatalf("shutdown still in phase %s after %s", o.Phase(), timeout)
+	}
+}
+
+func TestPhaseOrder(t *testing.T) {
+	cm := connmanager.NewConnectionManager()
+	connect(t, cm, 2)
+	o := NewOrchestrator(cm, drain.NewEngine(cm), Config{CloseTimeout: 2 * time.Second})
+	entered := record(o)
+
+	o.Trigger()
+	o.Trigger()
+	wait(t, o, 5*time.Second)
+
+	if got := entered(); !slices.Equal(got, allPhases) {
+		t.Errorf("phases %v, want %v", got, allPhases)
+	}
+	status := o.Status()
+	if status.Phase != PhaseStopped || len(status.Transitions) != len(allPhases) {
+		t.Errorf("status %+v", status)
+	}
+	if !cm.Draining() {
+		t.Error("server ready after shutdown")
+	}
+	if n := cm.GetConnectionsCount(); n != 0 {
+		t.Errorf("%d connections left after shutdown", n)
+	}
+}
+
+func TestForce(t *testing.T) {
+	cm := connmanager.NewConnectionManager()
+	connect(t, cm, 2)
+	o := NewOrchestrator(cm, drain.NewEngine(cm), Config{
+		DeregisterDelay: time.Hour,
+		DrainDuration:   time.Hour,
+		InFlightGrace:   time.Hour,
+		CloseTimeout:    time.Hour,
+	})
+	entered := record(o)
+	deregistering := make(chan struct{})
+	o.OnPhase(PhaseDeregister, func(ctx context.Context, phase Phase) { close(deregistering) })
+
+	o.Trigger()
+	<-deregistering
+	o.Force()
+	wait(t, o, 5*time.Second)
+
+	// Forcing skips the waits, not the phases
+	if got := entered(); !slices.Equal(got, allPhases) {
+		t.Errorf("phases %v, want %v", got, allPhases)
+	}
+	if n := cm.GetConnectionsCount(); n != 0 {
+		t.Errorf("%d connections left after a forced shutdown", n)
+	}
+}
+
+func TestDrainLeavesBusyConnectionsToGrace(t *testing.T) {
+	cm := connmanager.NewConnectionManager()
+	connections := connect(t, cm, 3)
+	busy := connections[0]
+	op := cm.BeginOperation(busy, "slow")
+	o := NewOrchestrator(cm, drain.NewEngine(cm), Config{
+		DrainDuration: time.Minute,
+		InFlightGrace: time.Minute,
+		CloseTimeout:  2 * time.Second,
+	})
+
+	settled := make(chan bool, 1)
+	o.OnPhase(PhaseInFlightGrace, func(ctx context.Context, phase Phase) {
+		_, tracked := cm.GetConnection(busy.ID)
+		interrupted := false
+		select {
+		case <-op.Interrupted():
+			interrupted = true
+		default:
+		}
+		settled <- tracked && !interrupted && cm.GetConnectionsCount() == 1
+		op.End()
+	})
+
+	// The drain ends once only busy connections are left and the grace once
+	// the operation ended, neither waits for its timeout
+	o.Trigger()
+	wait(t, o, 10*time.Second)
+
+	if !<-settled {
+		t.Error("drain closed or interrupted the busy connection before the in-flight grace")
+	}
+}
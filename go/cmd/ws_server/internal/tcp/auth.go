@@ -0,0 +1,170 @@
+package tcp
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/control"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// AuthConfig controls how control clients are authenticated. With nothing
+// set every client is trusted as an admin, matching the historical behavior.
+type AuthConfig struct {
+	// CertFile and KeyFile enable TLS on the listener
+	CertFile string
+	KeyFile  string
+	// ClientCAFile requires clients to present a certificate signed by this CA
+	ClientCAFile string
+	// AdminCommonNames restricts the admin role to client certificates with
+	// one of these common names, other verified clients are read-only. Empty
+	// means every verified client is an admin.
+	AdminCommonNames []string
+
+	// AdminSecret and ReadOnlySecret enable the shared-secret handshake.
+	// The secret a client proves knowledge of decides its role.
+	AdminSecret    string
+	ReadOnlySecret string
+}
+
+func (c AuthConfig) secretsEnabled() bool {
+	return c.AdminSecret != "" || c.ReadOnlySecret != ""
+}
+
+// TLSConfig builds the listener TLS configuration, or returns nil when TLS
+// is not configured
+func (c AuthConfig) TLSConfig() (*tls.Config, error) {
+	if c.CertFile == "" && c.KeyFile == "" {
+		if c.ClientCAFile != "" {
+			return nil, errors.New("client CA requires a server certificate and key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("client CA file contains no certificates")
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// authenticate runs the TLS and shared-secret checks configured for conn and
+// returns the role the client was granted
+func (c AuthConfig) authenticate(conn net.Conn, reader *bufio.Scanner) (control.Role, error) {
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return "", err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	role := control.RoleAdmin
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return "", fmt.Errorf("TLS handshake: %w", err)
+		}
+		role = c.certRole(tlsConn.ConnectionState())
+	}
+
+	if !c.secretsEnabled() {
+		return role, nil
+	}
+
+	secretRole, err := c.challenge(conn, reader)
+	if err != nil {
+		return "", err
+	}
+	// A client never gets more than both checks grant it
+	if secretRole == control.RoleReadOnly {
+		role = control.RoleReadOnly
+	}
+	return role, nil
+}
+
+func (c AuthConfig) certRole(state tls.ConnectionState) control.Role {
+	if len(c.AdminCommonNames) == 0 || len(state.PeerCertificates) == 0 {
+		return control.RoleAdmin
+	}
+	if slices.Contains(c.AdminCommonNames, state.PeerCertificates[0].Subject.CommonName) {
+		return control.RoleAdmin
+	}
+	return control.RoleReadOnly
+}
+
+// challenge runs the shared-secret handshake:
+//
+//	server: AUTH <hex nonce>
+//	client: AUTH <hex HMAC-SHA256(secret, nonce)>
+//	server: OK <role> | ERR authentication failed
+func (c AuthConfig) challenge(conn net.Conn, reader *bufio.Scanner) (control.Role, error) {
+	nonce := make([]byte, 32)
+	// crypto/rand.Read never returns an error
+	_, _ = rand.Read(nonce)
+	challenge := hex.EncodeToString(nonce)
+
+	if _, err := fmt.Fprintln(conn, "AUTH "+challenge); err != nil {
+		return "", err
+	}
+	if !reader.Scan() {
+		return "", errors.New("connection closed during authentication")
+	}
+
+	answer, ok := strings.CutPrefix(strings.TrimSpace(reader.Text()), "AUTH ")
+	mac, err := hex.DecodeString(answer)
+	if !ok || err != nil {
+		fmt.Fprintln(conn, "ERR authentication failed")
+		return "", errors.New("malformed authentication response")
+	}
+
+	var role control.Role
+	switch {
+	case c.AdminSecret != "" && hmac.Equal(mac, SignChallenge(c.AdminSecret, challenge)):
+		role = control.RoleAdmin
+	case c.ReadOnlySecret != "" && hmac.Equal(mac, SignChallenge(c.ReadOnlySecret, challenge)):
+		role = control.RoleReadOnly
+	default:
+		fmt.Fprintln(conn, "ERR authentication failed")
+		return "", errors.New("invalid authentication response")
+	}
+
+	if _, err := fmt.Fprintln(conn, "OK "+string(role)); err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// SignChallenge computes the response a client holding secret sends for the
+// given hex challenge
+func SignChallenge(secret, challenge string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(challenge))
+	return h.Sum(nil)
+}
@@ -0,0 +1,297 @@
+package tcp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/control"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+	"github.com/ArditZubaku/go-node-ws/internal/shutdown"
+)
+
+// pki is a test CA with the files of the certificates it issued
+type pki struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// CAFile holds the CA certificate
+	CAFile string
+}
+
+func newPKI(t *testing.T) *pki {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pki{t: t, dir: t.TempDir(), cert: cert, key: key}
+	p.CAFile = p.write("ca.crt", "CERTIFICATE", der)
+	return p
+}
+
+func (p *pki) write(name, blockType string, der []byte) string {
+	p.t.Helper()
+	path := filepath.Join(p.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		p.t.Fatal(err)
+	}
+	return path
+}
+
+// issue signs a certificate for commonName and returns its certificate and
+// key files
+func (p *pki) issue(commonName string, usage x509.ExtKeyUsage) (string, string) {
+	p.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return p.write(commonName+".crt", "CERTIFICATE", der), p.write(commonName+".key", "EC PRIVATE KEY", keyDER)
+}
+
+// clientTLS returns the configuration of a client presenting commonName's
+// certificate
+func (p *pki) clientTLS(commonName string) *tls.Config {
+	p.t.Helper()
+	certFile, keyFile := p.issue(commonName, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(p.cert)
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: roots, ServerName: "localhost"}
+}
+
+// serve runs the service port with auth and returns its address
+func serve(t *testing.T, auth AuthConfig) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	cm := connmanager.NewConnectionManager()
+	engine := drain.NewEngine(cm)
+	orch := shutdown.NewOrchestrator(cm, engine, shutdown.Config{})
+	go HandleCleanUpTask(ln, cm, engine, orch, auth)
+	return ln.Addr().String()
+}
+
+// client is a connection to the service port
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Scanner
+}
+
+func newClient(t *testing.T, conn net.Conn) *client {
+	t.Helper()
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &client{t: t, conn: conn, reader: bufio.NewScanner(conn)}
+}
+
+func (c *client) readLine() (string, bool) {
+	if !c.reader.Scan() {
+		return "", false
+	}
+	return c.reader.Text(), true
+}
+
+// answer completes the shared-secret handshake with secret and returns the
+// server's verdict
+func (c *client) answer(secret string) string {
+	c.t.Helper()
+	line, ok := c.readLine()
+	challenge, found := strings.CutPrefix(line, "AUTH ")
+	if !ok || !found {
+		c.t.Fatalf("challenge %q", line)
+	}
+	fmt.Fprintf(c.conn, "AUTH %s\n", hex.EncodeToString(SignChallenge(secret, challenge)))
+	verdict, _ := c.readLine()
+	return verdict
+}
+
+// run sends a JSON request and returns the error code of its response,
+// empty when it succeeded
+func (c *client) run(command string) control.ErrorCode {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, `{"v":1,"id":"1","cmd":%q}`+"\n", command)
+	line, ok := c.readLine()
+	if !ok {
+		c.t.Fatalf("%s: connection closed", command)
+	}
+	var resp control.Response
+	if err := json.Unmarshal([]byte(line), &resp); err != nil {
+		c.t.Fatalf("%s: response %q", command, line)
+	}
+	if resp.Error != nil {
+		return resp.Error.Code
+	}
+	return ""
+}
+
+// role probes the role of a client: status is allowed for both roles,
+// pause only for admins, who get a conflict since no drain runs
+func (c *client) role() control.Role {
+	c.t.Helper()
+	if code := c.run("status"); code != "" {
+		c.t.Fatalf("status: %s", code)
+	}
+	switch code := c.run("pause"); code {
+	case control.CodeForbidden:
+		return control.RoleReadOnly
+	case control.CodeConflict:
+		return control.RoleAdmin
+	default:
+		c.t.Fatalf("pause: unexpected result %q", code)
+		return ""
+	}
+}
+
+func TestMutualTLSRoles(t *testing.T) {
+	p := newPKI(t)
+	certFile, keyFile := p.issue("server", x509.ExtKeyUsageServerAuth)
+	addr := serve(t, AuthConfig{
+		CertFile:         certFile,
+		KeyFile:          keyFile,
+		ClientCAFile:     p.CAFile,
+		AdminCommonNames: []string{"cleanup-svc"},
+	})
+
+	for cn, want := range map[string]control.Role{"cleanup-svc": control.RoleAdmin, "dashboard": control.RoleReadOnly} {
+		conn, err := tls.Dial("tcp", addr, p.clientTLS(cn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := newClient(t, conn).role(); got != want {
+			t.Errorf("client %s: role %q, want %q", cn, got, want)
+		}
+	}
+
+	// Clients without a certificate signed by the CA are refused
+	other := newPKI(t)
+	conn, err := tls.Dial("tcp", addr, other.clientTLS("cleanup-svc"))
+	if err == nil {
+		c := newClient(t, conn)
+		if _, ok := c.readLine(); ok {
+			t.Error("client with a foreign certificate was served")
+		}
+	}
+}
+
+func TestSharedSecret(t *testing.T) {
+	addr := serve(t, AuthConfig{AdminSecret: "admin-secret", ReadOnlySecret: "read-secret"})
+	dial := func() *client {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newClient(t, conn)
+	}
+
+	tests := []struct {
+		secret string
+		want   control.Role
+	}{
+		{"admin-secret", control.RoleAdmin},
+		{"read-secret", control.RoleReadOnly},
+	}
+	for _, tt := range tests {
+		c := dial()
+		if verdict := c.answer(tt.secret); verdict != "OK "+string(tt.want) {
+			t.Fatalf("%s: verdict %q", tt.secret, verdict)
+		}
+		if got := c.role(); got != tt.want {
+			t.Errorf("%s: role %q, want %q", tt.secret, got, tt.want)
+		}
+	}
+
+	c := dial()
+	if verdict := c.answer("wrong"); verdict != "ERR authentication failed" {
+		t.Errorf("wrong secret: verdict %q", verdict)
+	}
+	if line, ok := c.readLine(); ok {
+		t.Errorf("connection still open after a failed handshake, read %q", line)
+	}
+
+	c = dial()
+	c.readLine()
+	fmt.Fprintln(c.conn, "AUTH not-hex")
+	if verdict, _ := c.readLine(); verdict != "ERR authentication failed" {
+		t.Errorf("malformed answer: verdict %q", verdict)
+	}
+}
+
+func TestReadOnlyRefusedDestructiveCommands(t *testing.T) {
+	addr := serve(t, AuthConfig{ReadOnlySecret: "read-secret"})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(t, conn)
+	c.answer("read-secret")
+	for _, command := range []string{"close", "drain", "retune", "pause", "resume", "cancel", "kick", "broadcast", "send", "upgrade"} {
+		if code := c.run(command); code != control.CodeForbidden {
+			t.Errorf("%s: code %q, want %s", command, code, control.CodeForbidden)
+		}
+	}
+	for _, command := range []string{"status", "list", "phase"} {
+		if code := c.run(command); code != "" {
+			t.Errorf("%s: code %q, want success", command, code)
+		}
+	}
+}
@@ -3,55 +3,114 @@ package tcp
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
-	"strconv"
+	"strings"
 
 	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/control"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+	"github.com/ArditZubaku/go-node-ws/internal/shutdown"
 )
 
-func HandleCleanUpTask(cm *connmanager.ConnectionManager) {
-	ln, err := net.Listen("tcp", ":9999")
+// HandleCleanUpTask serves the service port on ln until it is closed
+func HandleCleanUpTask(ln net.Listener, cm *connmanager.ConnectionManager, engine *drain.Engine, orch *shutdown.Orchestrator, auth AuthConfig) {
+	tlsCfg, err := auth.TLSConfig()
 	if err != nil {
-		slog.Error("Failed to listen on TCP port", "error", err)
+		slog.Error("Invalid service communication TLS configuration", "error", err)
 		return
 	}
+
+	if tlsCfg != nil {
+		ln = tls.NewListener(ln, tlsCfg)
+	}
 	defer ln.Close()
 
-	slog.Info("Service communication server listening on", "addr", ln.Addr().String())
+	slog.Info(
+		"Service communication server listening on",
+		"addr", ln.Addr().String(),
+		"tls", tlsCfg != nil,
+		"mutual_tls", tlsCfg != nil && tlsCfg.ClientCAs != nil,
+		"shared_secret", auth.secretsEnabled(),
+	)
 
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			slog.Error("Failed to accept TCP connection", "error", err)
 			continue
 		}
-		go handleServiceConnection(conn, cm)
+		go handleServiceConnection(conn, cm, engine, orch, auth)
 	}
 }
 
-func handleServiceConnection(conn net.Conn, cm *connmanager.ConnectionManager) {
+func handleServiceConnection(conn net.Conn, cm *connmanager.ConnectionManager, engine *drain.Engine, orch *shutdown.Orchestrator, auth AuthConfig) {
 	defer conn.Close()
 
 	reader := bufio.NewScanner(conn)
 
+	role, err := auth.authenticate(conn, reader)
+	if err != nil {
+		slog.Warn("Service client authentication failed", "remote_addr", conn.RemoteAddr(), "error", err)
+		return
+	}
+	slog.Info("Service client connected", "remote_addr", conn.RemoteAddr(), "role", role)
+
 	for reader.Scan() {
-		msg := reader.Text()
-		n, err := strconv.Atoi(msg)
-		if err != nil {
-			slog.Error("Invalid number received", "error", err)
+		line := strings.TrimSpace(reader.Text())
+		if line == "" {
 			continue
 		}
-		slog.Info("Received service message", "message", n)
 
-		cm.CloseFirstNConnections(n)
+		// JSON objects use the structured protocol, anything else is a
+		// legacy plain-text command translated to it
+		var response string
+		if strings.HasPrefix(line, "{") {
+			response = handleJSONCommand(line, conn, role, cm, engine, orch)
+		} else {
+			response = handleTextCommand(strings.Fields(line), conn, role, cm, engine, orch)
+		}
 
 		// No need for newline, fmt.Fprintln adds it
-		n, err = fmt.Fprintln(conn, "Closing "+msg+" WS connections")
+		n, err := fmt.Fprintln(conn, response)
 		if n == 0 || err != nil {
 			slog.Error("Failed to write service response", "error", err)
 			return
 		}
 	}
 }
+
+// handleJSONCommand executes one JSON-lines request and returns the encoded
+// response. Watched requests stream their events to w first.
+func handleJSONCommand(line string, w io.Writer, role control.Role, cm *connmanager.ConnectionManager, engine *drain.Engine, orch *shutdown.Orchestrator) string {
+	var resp control.Response
+	var req control.Request
+	if err := json.Unmarshal([]byte(line), &req); err != nil {
+		resp = control.Response{
+			Version: control.ProtocolVersion,
+			Error:   control.NewError(control.CodeBadRequest, "invalid request: %s", err),
+		}
+		slog.Error("Service request failed", "code", resp.Error.Code, "error", resp.Error.Message)
+	} else {
+		resp = control.Run(req, w, role, cm, engine, orch)
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		slog.Error("Failed to encode service response", "error", err)
+		b, _ = json.Marshal(control.Response{
+			Version: control.ProtocolVersion,
+			ID:      req.ID,
+			Error:   control.NewError(control.CodeInternal, "failed to encode response"),
+		})
+	}
+	return string(b)
+}
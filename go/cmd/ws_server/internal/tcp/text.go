@@ -0,0 +1,178 @@
+package tcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/control"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+	"github.com/ArditZubaku/go-node-ws/internal/shutdown"
+)
+
+// closeArgs and drainArgs are the JSON args of the control commands a
+// plain-text command stands for
+type closeArgs struct {
+	Count    int    `json:"count"`
+	Strategy string `json:"strategy,omitempty"`
+}
+
+type drainArgs struct {
+	Mode              drain.Mode `json:"mode,omitempty"`
+	Percent           float64    `json:"percent,omitempty"`
+	Count             int        `json:"count,omitempty"`
+	Interval          string     `json:"interval,omitempty"`
+	Duration          string     `json:"duration,omitempty"`
+	Strategy          string     `json:"strategy,omitempty"`
+	InFlight          string     `json:"in_flight,omitempty"`
+	WaitTimeout       string     `json:"wait_timeout,omitempty"`
+	ReconnectEndpoint string     `json:"reconnect_endpoint,omitempty"`
+}
+
+// handleTextCommand runs a legacy plain-text command through the control
+// package and answers in the plain-text format: a message or JSON line, or
+// "Error: <message>". Watched commands write one bare JSON event per line
+// to w first and answer with the summary.
+func handleTextCommand(fields []string, w io.Writer, role control.Role, cm *connmanager.ConnectionManager, engine *drain.Engine, orch *shutdown.Orchestrator) string {
+	req, err := textRequest(fields)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	if req.Watch {
+		w = eventWriter{w}
+	}
+	resp := control.Run(req, w, role, cm, engine, orch)
+	if resp.Error != nil {
+		return "Error: " + resp.Error.Message
+	}
+
+	result := textResult(req, resp.Result)
+	if summary, ok := result.(control.WatchSummary); ok {
+		summary.Result = textResult(req, summary.Result)
+		result = summary
+	}
+	if s, ok := result.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return string(b)
+}
+
+// textRequest translates a plain-text command into the control request it
+// stands for:
+//
+//	<count> [strategy]             close
+//	drain|retune <key=value>...    drain, retune
+//	pause|resume|cancel|status     the command of the same name
+//	watch <count> [strategy]       a watched close
+//	watch drain <key=value>...     a watched drain
+func textRequest(fields []string) (control.Request, error) {
+	req := control.Request{Version: control.ProtocolVersion}
+	if fields[0] == "watch" {
+		if len(fields) == 1 {
+			return req, fmt.Errorf("usage: watch <count> [strategy] | watch drain <key=value>...")
+		}
+		req.Watch = true
+		fields = fields[1:]
+	}
+
+	var args any
+	if n, err := strconv.Atoi(fields[0]); err == nil {
+		req.Command = "close"
+		c := closeArgs{Count: n}
+		if len(fields) > 1 {
+			c.Strategy = fields[1]
+		}
+		args = c
+	} else {
+		req.Command = fields[0]
+		switch req.Command {
+		case "drain", "retune":
+			plan, err := drain.ParsePlan(fields[1:])
+			if err != nil {
+				return req, err
+			}
+			args = planArgs(plan)
+		case "pause", "resume", "cancel", "status":
+		default:
+			return req, fmt.Errorf("unknown command %q", req.Command)
+		}
+	}
+	if req.Watch && req.Command != "close" && req.Command != "drain" {
+		return req, fmt.Errorf("%q cannot be watched", fields[0])
+	}
+
+	if args != nil {
+		raw, err := json.Marshal(args)
+		if err != nil {
+			return req, err
+		}
+		req.Args = raw
+	}
+	return req, nil
+}
+
+// planArgs converts a parsed plan back to the args of a drain request,
+// leaving out what the text did not set
+func planArgs(plan drain.Plan) drainArgs {
+	args := drainArgs{
+		Mode:              plan.Mode,
+		Percent:           plan.Percent,
+		Count:             plan.Count,
+		Interval:          durationArg(plan.Interval),
+		Duration:          durationArg(plan.Duration),
+		InFlight:          string(plan.Close.Policy),
+		WaitTimeout:       durationArg(plan.Close.Timeout),
+		ReconnectEndpoint: plan.Close.Reconnect.Endpoint,
+	}
+	if plan.Strategy != nil {
+		args.Strategy = plan.Strategy.Name()
+	}
+	return args
+}
+
+func durationArg(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// textResult is the plain-text form of the result of req: closes are
+// announced, status only reports the drain, the rest is sent as JSON
+func textResult(req control.Request, result any) any {
+	switch r := result.(type) {
+	case control.StatusResult:
+		return r.Drain
+	case map[string]int:
+		if req.Command == "close" {
+			var args closeArgs
+			_ = json.Unmarshal(req.Args, &args)
+			return "Closing " + strconv.Itoa(args.Count) + " WS connections"
+		}
+	}
+	return result
+}
+
+// eventWriter unwraps the event lines control.Run writes for a watched
+// request, the plain-text protocol streams the bare events
+type eventWriter struct {
+	w io.Writer
+}
+
+func (e eventWriter) Write(p []byte) (int, error) {
+	var line control.EventLine
+	if err := json.Unmarshal(p, &line); err != nil {
+		return 0, err
+	}
+	if err := control.WriteJSONLine(e.w, line.Event); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,114 @@
+package tcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ArditZubaku/go-node-ws/internal/control"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
+)
+
+func TestTextRequest(t *testing.T) {
+	tests := []struct {
+		line    string
+		command string
+		watch   bool
+		args    string
+	}{
+		{"5", "close", false, `{"count":5}`},
+		{"5 oldest", "close", false, `{"count":5,"strategy":"oldest"}`},
+		{"watch 2", "close", true, `{"count":2}`},
+		{"drain rate=10 interval=10s", "drain", false, `{"mode":"rate","count":10,"interval":"10s"}`},
+		{"watch drain percent=5 interval=2s", "drain", true, `{"mode":"percent","percent":5,"interval":"2s"}`},
+		{"drain spread=3m strategy=newest inflight=wait wait=10s", "drain", false, `{"mode":"spread","duration":"3m0s","strategy":"newest","in_flight":"wait","wait_timeout":"10s"}`},
+		{"retune rate=20 interval=5s", "retune", false, `{"mode":"rate","count":20,"interval":"5s"}`},
+		{"status", "status", false, ""},
+		{"pause", "pause", false, ""},
+		{"resume", "resume", false, ""},
+		{"cancel", "cancel", false, ""},
+	}
+	for _, tt := range tests {
+		req, err := textRequest(strings.Fields(tt.line))
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if req.Command != tt.command || req.Watch != tt.watch || string(req.Args) != tt.args {
+			t.Errorf("%q: command %q watch %v args %s, want %q %v %s", tt.line, req.Command, req.Watch, req.Args, tt.command, tt.watch, tt.args)
+		}
+		if req.Version != control.ProtocolVersion {
+			t.Errorf("%q: version %d", tt.line, req.Version)
+		}
+	}
+
+	for _, line := range []string{"watch", "watch status", "list", "drain rate=ten", "hello"} {
+		if _, err := textRequest(strings.Fields(line)); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+func TestTextCommands(t *testing.T) {
+	conn, err := net.Dial("tcp", serve(t, AuthConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(t, conn)
+	send := func(line string) string {
+		t.Helper()
+		fmt.Fprintln(c.conn, line)
+		resp, ok := c.readLine()
+		if !ok {
+			t.Fatalf("%s: connection closed", line)
+		}
+		return resp
+	}
+
+	if resp := send("3"); resp != "Closing 3 WS connections" {
+		t.Errorf("close: %q", resp)
+	}
+
+	// Status only reports the drain, as it did before the JSON protocol
+	var status drain.Status
+	if err := json.Unmarshal([]byte(send("status")), &status); err != nil || status.State != drain.StateIdle {
+		t.Errorf("status: %+v, %v", status, err)
+	}
+
+	var summary control.WatchSummary
+	if err := json.Unmarshal([]byte(send("watch 2")), &summary); err != nil || summary.Type != "summary" || summary.Result != "Closing 2 WS connections" {
+		t.Errorf("watch: %+v, %v", summary, err)
+	}
+
+	for line, want := range map[string]string{
+		"pause":      "Error: no drain in progress",
+		"hello":      `Error: unknown command "hello"`,
+		"watch list": `Error: unknown command "list"`,
+	} {
+		if resp := send(line); resp != want {
+			t.Errorf("%s: %q, want %q", line, resp, want)
+		}
+	}
+}
+
+func TestTextCommandsRespectRole(t *testing.T) {
+	conn, err := net.Dial("tcp", serve(t, AuthConfig{ReadOnlySecret: "read-secret"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(t, conn)
+	c.answer("read-secret")
+	for _, line := range []string{"5", "watch 5", "drain rate=1 interval=1s", "cancel"} {
+		fmt.Fprintln(c.conn, line)
+		resp, _ := c.readLine()
+		if !strings.HasPrefix(resp, "Error: role \"read\" may not run") {
+			t.Errorf("%s: %q, want a refusal", line, resp)
+		}
+	}
+	fmt.Fprintln(c.conn, "status")
+	if resp, _ := c.readLine(); strings.HasPrefix(resp, "Error: ") {
+		t.Errorf("status: %q", resp)
+	}
+}
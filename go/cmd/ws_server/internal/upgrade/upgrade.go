@@ -0,0 +1,205 @@
+// Package upgrade replaces the running binary without closing its listening
+// sockets. The old process starts the new one with the sockets as inherited
+// file descriptors, waits until it reports ready and then stops accepting,
+// the way HAProxy reloads itself.
+package upgrade
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// envListeners names the inherited listeners in file descriptor order,
+	// starting after the ready pipe
+	envListeners = "UPGRADE_LISTENERS"
+	// readyFD is the write end of the pipe the child reports ready on
+	readyFD = 3
+)
+
+type namedListener struct {
+	name string
+	ln   net.Listener
+}
+
+// Upgrader tracks the listeners a process hands to its successor
+type Upgrader struct {
+	// ReadyTimeout is how long Handoff waits for the new process
+	ReadyTimeout time.Duration
+
+	mu        sync.Mutex
+	listeners []namedListener
+	inherited map[string]*os.File
+	ready     *os.File
+}
+
+// New returns an Upgrader holding the listeners inherited from the parent
+// process, if this process was started by Handoff
+func New(readyTimeout time.Duration) *Upgrader {
+	u := &Upgrader{ReadyTimeout: readyTimeout, inherited: make(map[string]*os.File)}
+	names := os.Getenv(envListeners)
+	if names == "" {
+		return u
+	}
+	os.Unsetenv(envListeners)
+
+	u.ready = os.NewFile(readyFD, "upgrade-ready")
+	for i, name := range strings.Split(names, ",") {
+		u.inherited[name] = os.NewFile(uintptr(readyFD+1+i), name)
+	}
+	slog.Info("Started by an upgrade", "listeners", names, "parent_pid", os.Getppid())
+	return u
+}
+
+// Listen returns the listener the parent handed over under name, or a new
+// TCP listener on addr
+func (u *Upgrader) Listen(name, addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var ln net.Listener
+	var err error
+	if f, ok := u.inherited[name]; ok {
+		delete(u.inherited, name)
+		ln, err = net.FileListener(f)
+		// FileListener duplicates the descriptor
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting %s listener: %w", name, err)
+		}
+		slog.Info("Inherited listener", "name", name, "addr", ln.Addr().String())
+	} else {
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	u.listeners = append(u.listeners, namedListener{name, ln})
+	return ln, nil
+}
+
+// Ready tells the parent process, if any, that this process is listening
+// and it may stop accepting. Listeners the parent handed over but this
+// process did not take are closed.
+func (u *Upgrader) Ready() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for name, f := range u.inherited {
+		slog.Warn("Closing unused inherited listener", "name", name)
+		f.Close()
+		delete(u.inherited, name)
+	}
+	if u.ready == nil {
+		return
+	}
+	if _, err := u.ready.Write([]byte{1}); err != nil {
+		slog.Error("Failed to report ready to the parent process", "error", err)
+	}
+	u.ready.Close()
+	u.ready = nil
+}
+
+// Handoff starts a new process of the same binary, with the same arguments
+// and environment, that inherits every listener. Once the new process is
+// ready the listeners are closed here and its PID is returned. When it does
+// not become ready in time it is killed and this process keeps serving.
+// Callers must not run two handoffs at once, see shutdown.Orchestrator.
+func (u *Upgrader) Handoff() (int, error) {
+	u.mu.Lock()
+	listeners := append([]namedListener(nil), u.listeners...)
+	u.mu.Unlock()
+
+	pid, err := u.start(listeners)
+	if err != nil {
+		return 0, err
+	}
+	// Stop accepting, the new process owns the sockets now
+	for _, l := range listeners {
+		l.ln.Close()
+	}
+	return pid, nil
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+func (u *Upgrader) start(listeners []namedListener) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	files := []*os.File{w}
+	names := make([]string, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.ln.(filer)
+		if !ok {
+			return 0, fmt.Errorf("%s listener cannot be handed over", l.name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return 0, fmt.Errorf("duplicating %s listener: %w", l.name, err)
+		}
+		files = append(files, f)
+		names = append(names, l.name)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), envListeners+"="+strings.Join(names, ","))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("starting new process: %w", err)
+	}
+	slog.Info("Started new process, waiting for it to become ready", "pid", cmd.Process.Pid, "listeners", names)
+
+	// Close the write end here, so the read fails if the child exits
+	// without reporting ready
+	w.Close()
+	files = files[1:]
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := r.Read(b)
+		ready <- err
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-ready:
+		if err == nil {
+			return cmd.Process.Pid, nil
+		}
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new process did not report ready: %w", err)
+	case err := <-exited:
+		return 0, fmt.Errorf("new process exited before it was ready: %v", err)
+	case <-time.After(u.ReadyTimeout):
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new process not ready after %s", u.ReadyTimeout)
+	}
+}
@@ -0,0 +1,140 @@
+package upgrade
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// envChild makes the test binary act as the new process of a handoff:
+// "ready" serves the inherited listener, "hang" never reports ready
+const envChild = "UPGRADE_TEST_CHILD"
+
+// envPIDFile is where a child that hangs writes its PID
+const envPIDFile = "UPGRADE_TEST_PID_FILE"
+
+// Handoff starts os.Executable, the test binary, with the same arguments.
+// The guard keeps the child from running the tests again.
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(envChild); mode != "" {
+		runChild(mode)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func runChild(mode string) {
+	u := New(time.Second)
+	switch mode {
+	case "ready":
+		ln, err := u.Listen("test", "127.0.0.1:0")
+		if err != nil {
+			os.Exit(1)
+		}
+		u.Ready()
+		// Answer the parent once on the inherited socket, then exit
+		ln.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+		conn, err := ln.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		fmt.Fprintln(conn, os.Getpid())
+		conn.Close()
+	case "hang":
+		os.WriteFile(os.Getenv(envPIDFile), []byte(strconv.Itoa(os.Getpid())), 0o600)
+		time.Sleep(time.Minute)
+	}
+}
+
+// alive reports whether the process pid is still running
+func alive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+func TestHandoff(t *testing.T) {
+	t.Setenv(envChild, "ready")
+	u := New(5 * time.Second)
+	ln, err := u.Listen("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	pid, err := u.Handoff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid == 0 || pid == os.Getpid() {
+		t.Fatalf("Handoff returned PID %d", pid)
+	}
+
+	// The parent closed its copy, the child accepts on the same address
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("parent listener still accepting: %v", err)
+	}
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(line); got != strconv.Itoa(pid) {
+		t.Errorf("connection served by PID %s, want %d", got, pid)
+	}
+}
+
+func TestHandoffNotReady(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	t.Setenv(envChild, "hang")
+	t.Setenv(envPIDFile, pidFile)
+	u := New(500 * time.Millisecond)
+	ln, err := u.Listen("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if pid, err := u.Handoff(); err == nil {
+		t.Fatalf("Handoff to a child that never reports ready returned PID %d", pid)
+	}
+
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := strconv.Atoi(string(b))
+	for deadline := time.Now().Add(5 * time.Second); alive(pid); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("child %d still running after the failed handoff", pid)
+		}
+	}
+
+	// The parent keeps serving on its listener
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("parent listener closed after a failed handoff: %v", err)
+	}
+	conn.Close()
+}
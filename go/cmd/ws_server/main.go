@@ -1,16 +1,228 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log/slog"
+	"net"
+	"os"
+	"time"
 
+	"github.com/ArditZubaku/go-node-ws/internal/admin"
+	"github.com/ArditZubaku/go-node-ws/internal/agentcheck"
+	"github.com/ArditZubaku/go-node-ws/internal/certs"
+	"github.com/ArditZubaku/go-node-ws/internal/config"
 	"github.com/ArditZubaku/go-node-ws/internal/connmanager"
+	"github.com/ArditZubaku/go-node-ws/internal/drain"
 	"github.com/ArditZubaku/go-node-ws/internal/http"
+	"github.com/ArditZubaku/go-node-ws/internal/metrics"
+	"github.com/ArditZubaku/go-node-ws/internal/proxyproto"
+	"github.com/ArditZubaku/go-node-ws/internal/router"
+	"github.com/ArditZubaku/go-node-ws/internal/session"
+	"github.com/ArditZubaku/go-node-ws/internal/shutdown"
 	"github.com/ArditZubaku/go-node-ws/internal/tcp"
+	"github.com/ArditZubaku/go-node-ws/internal/upgrade"
 )
 
 func main() {
 	slog.SetLogLoggerLevel(slog.LevelInfo)
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Configuration loaded", cfg.LogAttrs()...)
+
 	cm := connmanager.NewConnectionManager()
-	go tcp.HandleCleanUpTask(cm)
-	http.NewServer(cm).Start()
+	// Validated by config.Load
+	strategy, _ := connmanager.StrategyByName(cfg.Connections.DrainStrategy)
+	cm.SetDefaultStrategy(strategy)
+	cm.SetCloseOptions(closeOptions(cfg))
+	cm.SetSendOptions(sendOptions(cfg.Send))
+	cm.SetKeepaliveOptions(connmanager.KeepaliveOptions{
+		PingInterval: cfg.Keepalive.PingInterval,
+		PongTimeout:  cfg.Keepalive.PongTimeout,
+		IdleTimeout:  cfg.Keepalive.IdleTimeout,
+	})
+	cm.SetLogThreshold(cfg.Connections.LogThreshold)
+	metrics.NewGaugeFunc("ws_connections_active", "WebSocket connections currently open.", func() float64 {
+		return float64(cm.GetConnectionsCount())
+	})
+	metrics.NewGaugeFunc("ws_in_flight_operations", "Operations currently running across all connections.", func() float64 {
+		return float64(cm.InFlightCount())
+	})
+	engine := drain.NewEngine(cm)
+	orch := shutdown.NewOrchestrator(cm, engine, shutdownConfig(cfg))
+	go orch.HandleSignals()
+
+	// Listen before serving anything, so a process started by an upgrade
+	// only reports ready once it holds every listener
+	upg := upgrade.New(cfg.Upgrade.ReadyTimeout)
+	httpLn := listen(upg, "http", cfg.HTTP.Addr)
+	controlLn := listen(upg, "control", cfg.Control.Addr)
+	// Wrapped after the upgrader took the plain listeners, those are what a
+	// new process inherits
+	httpLn = proxyproto.NewListener(httpLn, "http", proxyConfig(cfg.ProxyProto, cfg.ProxyProto.HTTP))
+	controlLn = proxyproto.NewListener(controlLn, "control", proxyConfig(cfg.ProxyProto, cfg.ProxyProto.Control))
+	if cfg.HTTP.TLSCert != "" {
+		// The PROXY protocol header comes before the TLS handshake
+		reloader := tlsReloader(cfg.HTTP)
+		go reloader.Watch(orch.Done())
+		httpLn = reloader.NewListener(httpLn)
+	}
+	agentCheckLn := listen(upg, "agent_check", cfg.AgentCheck.Addr)
+	adminCfg := admin.Config{
+		Token:         cfg.Admin.Token,
+		ReadOnlyToken: cfg.Admin.ReadOnlyToken,
+		Settings:      cfg.Redacted(),
+	}
+	var adminLn net.Listener
+	if adminCfg.Enabled() {
+		adminLn = listen(upg, "admin", cfg.Admin.Addr)
+	}
+	upg.Ready()
+	orch.SetHandoff(upg.Handoff)
+
+	go tcp.HandleCleanUpTask(controlLn, cm, engine, orch, authConfig(cfg.Control))
+	if adminLn != nil {
+		go admin.NewServer(adminCfg, cm, engine, orch).Serve(adminLn)
+	} else {
+		slog.Info("Admin API disabled, set ADMIN_TOKEN to enable it")
+	}
+	go agentcheck.HandleAgentChecks(cm, agentCheckLn, cfg.AgentCheck.Capacity)
+	sessions := sessionManager(cfg.Session)
+	go sessions.SweepExpired(sessionSweepInterval, orch.Done())
+	http.NewServer(http.Config{
+		ReadTimeout:  cfg.HTTP.ReadTimeout,
+		WriteTimeout: cfg.HTTP.WriteTimeout,
+		IdleTimeout:  cfg.HTTP.IdleTimeout,
+	}, cm, orch, sessions, messageRouter(cm, cfg.Connections.SlowRequestDuration)).Start(httpLn)
+
+	// The HTTP server stops early in the shutdown sequence, or as soon as an
+	// upgrade hands its listener over. Keep the process alive until the
+	// remaining connections are drained. Trigger is a no-op when a signal or
+	// an upgrade already started the shutdown.
+	orch.Trigger()
+	<-orch.Done()
+	slog.Info("Shutdown complete")
+}
+
+// listen returns the listener named name, inherited from the process that
+// started this one during an upgrade or bound to addr
+func listen(upg *upgrade.Upgrader, name, addr string) net.Listener {
+	ln, err := upg.Listen(name, addr)
+	if err != nil {
+		slog.Error("Failed to bind listener", "name", name, "addr", addr, "error", err)
+		os.Exit(1)
+	}
+	return ln
+}
+
+// proxyConfig builds the PROXY protocol configuration of a listener using
+// mode
+func proxyConfig(cfg config.ProxyProto, mode string) proxyproto.Config {
+	// Validated by config.Load
+	m, _ := proxyproto.ParseMode(mode)
+	trusted, _ := proxyproto.ParsePrefixes(cfg.TrustedCIDRs)
+	return proxyproto.Config{Mode: m, Trusted: trusted, HeaderTimeout: cfg.HeaderTimeout}
+}
+
+// tlsReloader loads the WebSocket listener certificate
+func tlsReloader(cfg config.HTTP) *certs.Reloader {
+	// Validated by config.Load
+	clientAuth, _ := certs.ParseClientAuth(cfg.TLSClientAuth)
+	minVersion, _ := certs.ParseVersion(cfg.TLSMinVersion)
+	reloader, err := certs.NewReloader(certs.Config{
+		CertFile:       cfg.TLSCert,
+		KeyFile:        cfg.TLSKey,
+		ClientCAFile:   cfg.TLSClientCA,
+		ClientAuth:     clientAuth,
+		MinVersion:     minVersion,
+		ReloadInterval: cfg.TLSReloadInterval,
+	})
+	if err != nil {
+		slog.Error("Invalid TLS configuration", "error", err)
+		os.Exit(1)
+	}
+	return reloader
+}
+
+// messageRouter registers the WebSocket message handlers. Application
+// handlers go here next to the built-in examples.
+func messageRouter(cm *connmanager.ConnectionManager, slowDuration time.Duration) *router.Router {
+	rt := router.New(cm)
+	slow := router.Slow(slowDuration)
+	rt.HandlePrefix("", router.Echo)
+	rt.HandlePrefix("SLOW_REQUEST", slow)
+	rt.HandlePrefix("SLOW_PING", slow)
+	rt.HandleType("echo", router.Echo)
+	rt.HandleType("slow_request", slow)
+	slog.Info("Message routes registered", "routes", rt.Routes())
+	return rt
+}
+
+// sessionSweepInterval is how often expired sessions are removed from the
+// store
+const sessionSweepInterval = time.Minute
+
+// sessionManager builds the session store drained clients resume from. Point
+// the session dir of two processes at the same directory to resume across
+// them.
+func sessionManager(cfg config.Session) *session.Manager {
+	store, err := session.StoreByName(cfg.Store, cfg.Dir, cfg.TTL)
+	if err != nil {
+		slog.Error("Invalid session store", "error", err)
+		os.Exit(1)
+	}
+	return session.NewManager(store, cfg.Buffer)
+}
+
+func sendOptions(cfg config.Send) connmanager.SendOptions {
+	return connmanager.SendOptions{
+		QueueSize:    cfg.QueueSize,
+		Overflow:     connmanager.OverflowPolicy(cfg.OverflowPolicy),
+		BlockTimeout: cfg.BlockTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		CloseTimeout: cfg.CloseTimeout,
+	}
+}
+
+// closeOptions sets how connections with in-flight operations are closed and
+// what their clients are advised about reconnecting
+func closeOptions(cfg config.Config) connmanager.CloseOptions {
+	return connmanager.CloseOptions{
+		Policy:  connmanager.InFlightPolicy(cfg.Connections.InFlightPolicy),
+		Timeout: cfg.Connections.InFlightWaitTimeout,
+		Reconnect: connmanager.ReconnectAdvice{
+			Delay:    cfg.Reconnect.Delay,
+			Jitter:   cfg.Reconnect.Jitter,
+			Spread:   cfg.Reconnect.Spread,
+			Endpoint: cfg.Reconnect.Endpoint,
+		},
+	}
+}
+
+func shutdownConfig(cfg config.Config) shutdown.Config {
+	return shutdown.Config{
+		DeregisterDelay:      cfg.Shutdown.ReadinessDelay,
+		StopAcceptingTimeout: cfg.Shutdown.StopAcceptingTimeout,
+		DrainDuration:        cfg.Shutdown.DrainDuration,
+		InFlightGrace:        cfg.Shutdown.InFlightGrace,
+		CloseTimeout:         cfg.Shutdown.CloseTimeout,
+		UpgradeDrainDuration: cfg.Upgrade.DrainDuration,
+	}
+}
+
+func authConfig(cfg config.Control) tcp.AuthConfig {
+	return tcp.AuthConfig{
+		CertFile:         cfg.TLSCert,
+		KeyFile:          cfg.TLSKey,
+		ClientCAFile:     cfg.TLSClientCA,
+		AdminCommonNames: cfg.AdminCNs,
+		AdminSecret:      cfg.AdminSecret,
+		ReadOnlySecret:   cfg.ReadOnlySecret,
+	}
 }
@@ -48,6 +48,7 @@ function connectToApp(url, retryCount = 0, maxRetries = 5, clientId = 1) {
 		let waitingForSlowResponse = false;
 		let pingInterval;
 		let connectionEstablished = false;
+		let advisory = null;
 
 		const cleanup = () => {
 			if (pingInterval) {
@@ -85,6 +86,16 @@ function connectToApp(url, retryCount = 0, maxRetries = 5, clientId = 1) {
 			const message = data.toString();
 			console.log(`[Client ${clientId}][${url}][${elapsed.toFixed(1)}s] ${message}`);
 
+			// The server advises when and where to reconnect before closing
+			if (message.startsWith('RECONNECT ')) {
+				try {
+					advisory = JSON.parse(message.slice('RECONNECT '.length));
+				} catch (error) {
+					console.log(`[Client ${clientId}] Invalid reconnect advisory: ${error.message}`);
+				}
+				return;
+			}
+
 			// Handle slow mode responses
 			if (useSlowEndpoint && waitingForSlowResponse) {
 				if (message.startsWith('SLOW_COMPLETE') || message.startsWith('SLOW_INTERRUPTED')) {
@@ -109,6 +120,20 @@ function connectToApp(url, retryCount = 0, maxRetries = 5, clientId = 1) {
 			console.log(`[Client ${clientId}][${url}] Received ${messageCount} messages`);
 			console.log(`[Client ${clientId}][${url}] Close code: ${code}, reason: ${reason.toString()}`);
 
+			// Follow the server's reconnect advisory, it spreads the delays so
+			// clients do not all hit the other replicas at once
+			if (advisory) {
+				const delay = advisory.delay_ms + Math.floor(Math.random() * (advisory.jitter_ms + 1));
+				const target = advisory.endpoint || url;
+				console.log(`[Client ${clientId}] Server advised reconnect (${advisory.reason}). Reconnecting to ${target} in ${delay}ms...`);
+				setTimeout(() => {
+					connectToApp(target, 0, maxRetries, clientId)
+						.then(resolve)
+						.catch(reject);
+				}, delay);
+				return;
+			}
+
 			// Don't retry if server sent CloseGoingAway (1001) - indicates graceful shutdown
 			if (code === 1001) {
 				console.log(`[Client ${clientId}] Server is going away (graceful shutdown). Not retrying.`);